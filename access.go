@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// AccessPolicy restricts what an authenticated principal may read. Every
+// matcher is added to every query of that principal, so documents outside
+// the policy can never be returned whatever PromQL is sent.
+type AccessPolicy struct {
+	Matchers []string `yaml:"matchers"` // e.g. environment="staging", instance=~"web-.*"
+}
+
+// accessPolicies holds the parsed policy matchers, keyed by principal.
+var accessPolicies map[string][]*labels.Matcher
+
+// loadAccessPolicies parses the configured policies.
+func loadAccessPolicies(policies map[string]AccessPolicy) error {
+	parsed := make(map[string][]*labels.Matcher, len(policies))
+	for principal, p := range policies {
+		if len(p.Matchers) == 0 {
+			continue
+		}
+		ms, err := parser.ParseMetricSelector("{" + strings.Join(p.Matchers, ",") + "}")
+		if err != nil {
+			return fmt.Errorf("access policy for %q: %w", principal, err)
+		}
+		parsed[principal] = ms
+	}
+	accessPolicies = parsed
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/util/strutil"
+)
+
+const alertmanagerTimeout = 10 * time.Second
+
+// postableAlert is an alert in the Alertmanager v2 API format.
+type postableAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     *time.Time        `json:"startsAt,omitempty"`
+	EndsAt       *time.Time        `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// alertmanagerNotifier posts firing and resolved alerts to the Alertmanager v2 API.
+type alertmanagerNotifier struct {
+	url         string // e.g. http://alertmanager:9093
+	externalURL string
+	client      *http.Client
+}
+
+func newAlertmanagerNotifier(url, externalURL string) *alertmanagerNotifier {
+	return &alertmanagerNotifier{
+		url:         strings.TrimSuffix(url, "/"),
+		externalURL: strings.TrimSuffix(externalURL, "/"),
+		client:      &http.Client{Timeout: alertmanagerTimeout},
+	}
+}
+
+// notify implements rules.NotifyFunc. Alerts are converted the same way
+// Prometheus does and sent in the background so evaluation is not blocked.
+func (n *alertmanagerNotifier) notify(_ context.Context, expr string, alerts ...*rules.Alert) {
+	if len(alerts) == 0 {
+		return
+	}
+	payload := make([]postableAlert, 0, len(alerts))
+	for _, a := range alerts {
+		pa := postableAlert{
+			Labels:       a.Labels.Map(),
+			Annotations:  a.Annotations.Map(),
+			StartsAt:     timeOrNil(a.FiredAt),
+			EndsAt:       timeOrNil(a.ValidUntil),
+			GeneratorURL: n.externalURL + strutil.TableLinkForExpression(expr),
+		}
+		if !a.ResolvedAt.IsZero() {
+			pa.EndsAt = timeOrNil(a.ResolvedAt)
+		}
+		payload = append(payload, pa)
+	}
+	go func() {
+		if err := n.send(payload); err != nil {
+			slog.Error("Error sending alerts to Alertmanager", "url", n.url, "alerts", len(payload), "err", err)
+		}
+	}()
+}
+
+// timeOrNil leaves zero times out of the payload, so Alertmanager picks its
+// own defaults rather than reading 0001-01-01.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (n *alertmanagerNotifier) send(alerts []postableAlert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url+"/api/v2/alerts", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// alertJSON renders an active alert like the Prometheus /api/v1/alerts endpoint.
+func alertJSON(a *rules.Alert) map[string]interface{} {
+	out := map[string]interface{}{
+		"labels":      a.Labels.Map(),
+		"annotations": a.Annotations.Map(),
+		"state":       a.State.String(),
+		"activeAt":    a.ActiveAt,
+		"value":       fmt.Sprintf("%g", a.Value),
+	}
+	if !a.KeepFiringSince.IsZero() {
+		out["keepFiringSince"] = a.KeepFiringSince
+	}
+	return out
+}
+
+// alertingRuleJSON renders an alerting rule for /api/v1/rules. Only the
+// active alerts matching all matchers are listed, and the state of the rule
+// is that of the listed alerts.
+func alertingRuleJSON(rule *rules.AlertingRule, matchers []*labels.Matcher) map[string]interface{} {
+	alerts := []interface{}{}
+	state := rules.StateInactive
+	for _, a := range rule.ActiveAlerts() {
+		if !matchesAll(a.Labels, matchers) {
+			continue
+		}
+		alerts = append(alerts, alertJSON(a))
+		state = max(state, a.State)
+	}
+	return map[string]interface{}{
+		"type":          "alerting",
+		"name":          rule.Name(),
+		"query":         rule.Query().String(),
+		"duration":      rule.HoldDuration().Seconds(),
+		"keepFiringFor": rule.KeepFiringFor().Seconds(),
+		"labels":        rule.Labels().Map(),
+		"annotations":   rule.Annotations().Map(),
+		"state":         state.String(),
+		"alerts":        alerts,
+	}
+}
+
+// handleAlerts serves /api/v1/alerts with the pending and firing alerts the
+// caller's access policy allows.
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	scope, err := ruleScope(r)
+	if err != nil {
+		sendScopeError(w, err)
+		return
+	}
+	alerts := []interface{}{}
+	if ruleManager != nil {
+		for _, rule := range ruleManager.AlertingRules() {
+			for _, a := range rule.ActiveAlerts() {
+				if matchesAll(a.Labels, scope.Matchers) {
+					alerts = append(alerts, alertJSON(a))
+				}
+			}
+		}
+	}
+	sendJSON(w, map[string]interface{}{"alerts": alerts})
+}
+
+// alertStateMetrics are the series the rule manager writes for alerting rules.
+var alertStateMetrics = []string{"ALERTS", "ALERTS_FOR_STATE"}
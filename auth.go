@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TLSConfig configures HTTPS on the listener, in the spirit of the Prometheus exporter-toolkit web config.
+type TLSConfig struct {
+	CertFile       string `yaml:"certFile"`
+	KeyFile        string `yaml:"keyFile"`
+	ClientCAFile   string `yaml:"clientCAFile"`   // enables client certificate verification (mTLS)
+	ClientAuthType string `yaml:"clientAuthType"` // e.g. RequireAndVerifyClientCert
+	MinVersion     string `yaml:"minVersion"`     // TLS12 (default) or TLS13
+}
+
+// unauthenticatedPaths stay reachable without credentials so orchestrator probes keep working.
+var unauthenticatedPaths = map[string]bool{
+	"/-/healthy": true,
+	"/-/ready":   true,
+}
+
+// principalFromContext returns the authenticated user or token name, or "" when auth is disabled.
+func principalFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(ctxKeyPrincipal).(string)
+	return p
+}
+
+// buildTLSConfig returns the TLS settings for the listener, or nil when TLS is not configured.
+func buildTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		if cfg.ClientCAFile != "" {
+			return nil, errors.New("tls: clientCAFile requires certFile and keyFile")
+		}
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls: both certFile and keyFile must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: loading key pair: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch cfg.MinVersion {
+	case "", "TLS12":
+	case "TLS13":
+		tlsCfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("tls: unknown minVersion %q", cfg.MinVersion)
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates found in %s", cfg.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	switch cfg.ClientAuthType {
+	case "":
+	case "NoClientCert":
+		tlsCfg.ClientAuth = tls.NoClientCert
+	case "RequestClientCert":
+		tlsCfg.ClientAuth = tls.RequestClientCert
+	case "RequireAnyClientCert":
+		tlsCfg.ClientAuth = tls.RequireAnyClientCert
+	case "VerifyClientCertIfGiven":
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "RequireAndVerifyClientCert":
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tls: unknown clientAuthType %q", cfg.ClientAuthType)
+	}
+	if (tlsCfg.ClientAuth == tls.VerifyClientCertIfGiven || tlsCfg.ClientAuth == tls.RequireAndVerifyClientCert) && tlsCfg.ClientCAs == nil {
+		return nil, fmt.Errorf("tls: clientAuthType %s requires clientCAFile", cfg.ClientAuthType)
+	}
+	return tlsCfg, nil
+}
+
+// authenticator checks basic auth users (bcrypt hashes) and named bearer tokens.
+type authenticator struct {
+	users  map[string]string // user -> bcrypt hash
+	tokens map[string]string // name -> token
+
+	// dummyHash is compared against for unknown users, so that the response
+	// time does not reveal which users exist. Its cost is the highest of the
+	// users' hashes.
+	dummyHash []byte
+
+	// bcrypt is deliberately slow, so successful checks are cached by a
+	// digest of the credentials and the hash they were verified against.
+	mu    sync.Mutex
+	valid map[[sha256.Size]byte]bool
+}
+
+func newAuthenticator(users, tokens map[string]string) (*authenticator, error) {
+	maxCost := 0
+	for user, hash := range users {
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("basic auth user %q: invalid bcrypt hash: %w", user, err)
+		}
+		maxCost = max(maxCost, cost)
+	}
+	for name, token := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("bearer token %q is empty", name)
+		}
+	}
+	a := &authenticator{users: users, tokens: tokens, valid: map[[sha256.Size]byte]bool{}}
+	if len(users) > 0 {
+		var err error
+		if a.dummyHash, err = bcrypt.GenerateFromPassword([]byte("dummy"), maxCost); err != nil {
+			return nil, fmt.Errorf("basic auth: %w", err)
+		}
+	}
+	return a, nil
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.users) > 0 || len(a.tokens) > 0
+}
+
+// authenticate returns the principal name for the request credentials.
+func (a *authenticator) authenticate(r *http.Request) (string, bool) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		hash, known := a.users[user]
+		if !known {
+			_ = bcrypt.CompareHashAndPassword(a.dummyHash, []byte(pass))
+			return "", false
+		}
+		key := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + hash))
+		a.mu.Lock()
+		cached := a.valid[key]
+		a.mu.Unlock()
+		if cached {
+			return user, true
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+			return "", false
+		}
+		a.mu.Lock()
+		a.valid[key] = true
+		a.mu.Unlock()
+		return user, true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for name, want := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// withAuth rejects requests without valid credentials and records the principal in the request context.
+func withAuth(a *authenticator, next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		principal, ok := a.authenticate(r)
+		if !ok {
+			loggerFromContext(r.Context()).Info("Unauthorized request", "path", r.URL.Path)
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="promql2mongo"`)
+			}
+			sendJSONError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+			return
+		}
+		logger := loggerFromContext(r.Context()).With("principal", principal)
+		ctx := context.WithValue(r.Context(), ctxKeyPrincipal, principal)
+		ctx = context.WithValue(ctx, ctxKeyLogger, logger)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultCacheMaxEntries    = 1000
+	defaultCacheSplitInterval = 24 * time.Hour
+	defaultCacheMaxFreshness  = 10 * time.Minute
+	defaultCacheTTL           = 24 * time.Hour
+)
+
+// CacheConfig configures the results cache for range queries. Queries are
+// split into intervals aligned to SplitInterval; intervals that ended more
+// than MaxFreshness ago are cached, so repeated dashboard queries only fetch
+// the recent tail from MongoDB.
+type CacheConfig struct {
+	Enabled           bool   `yaml:"enabled"`
+	MaxEntries        int    `yaml:"maxEntries"`        // intervals kept in memory (LRU)
+	SplitInterval     int    `yaml:"splitInterval"`     // seconds, rounded up to a multiple of the query step
+	MaxFreshness      int    `yaml:"maxFreshness"`      // seconds; intervals ending later than now minus this are never cached
+	TTL               int    `yaml:"ttl"`               // seconds a cached interval stays valid
+	PersistCollection string `yaml:"persistCollection"` // optional MongoDB collection that persists entries across restarts
+}
+
+// resultsCache holds the cache in use; nil when caching is disabled.
+var resultsCache *queryCache
+
+// cachedSeries is one series of a cached interval.
+type cachedSeries struct {
+	Metric     map[string]string `bson:"metric"`
+	Timestamps []float64         `bson:"timestamps"`
+	Values     []string          `bson:"values"`
+}
+
+type cacheEntry struct {
+	key       string
+	series    []cachedSeries
+	expiresAt time.Time
+}
+
+// queryCache is an LRU of query results per interval, optionally backed by a
+// MongoDB collection so that a restarted bridge starts warm.
+type queryCache struct {
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List // front is most recently used
+	max       int
+	split     time.Duration
+	freshness time.Duration
+	ttl       time.Duration
+	persist   string
+}
+
+func newQueryCache(cfg CacheConfig) *queryCache {
+	max := cfg.MaxEntries
+	if max <= 0 {
+		max = defaultCacheMaxEntries
+	}
+	return &queryCache{
+		entries:   map[string]*list.Element{},
+		lru:       list.New(),
+		max:       max,
+		split:     secondsOr(cfg.SplitInterval, defaultCacheSplitInterval),
+		freshness: secondsOr(cfg.MaxFreshness, defaultCacheMaxFreshness),
+		ttl:       secondsOr(cfg.TTL, defaultCacheTTL),
+		persist:   cfg.PersistCollection,
+	}
+}
+
+// setupCache creates the results cache and, with persistence enabled, the
+// TTL index that lets MongoDB expire persisted entries.
+func setupCache(ctx context.Context, cfg CacheConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	c := newQueryCache(cfg)
+	if c.persist != "" {
+		defer useMongo()()
+		_, err := c.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		if err != nil {
+			slog.Warn("Could not create TTL index on cache collection", "collection", c.persist, "err", err)
+		}
+	}
+	resultsCache = c
+	slog.Info("Results cache enabled", "maxEntries", c.max, "splitInterval", c.split, "maxFreshness", c.freshness, "persistCollection", c.persist)
+}
+
+func (c *queryCache) collection() *mongo.Collection {
+	return mongoClient().Database(conf.MongoDB.Database).Collection(c.persist)
+}
+
+// cacheInterval is an aligned, half-open interval [start, end).
+type cacheInterval struct {
+	start, end time.Time
+}
+
+// splitRange returns the aligned intervals covering [start, end]. Boundaries
+// are multiples of the split interval, rounded up to a multiple of step so
+// that every boundary falls on a step. Intervals are aligned rather than cut
+// at the query start so a dashboard sliding its window reuses the same keys.
+func (c *queryCache) splitRange(start, end time.Time, step time.Duration) []cacheInterval {
+	split := c.split
+	if rem := split % step; rem != 0 {
+		split += step - rem
+	}
+	var intervals []cacheInterval
+	from := time.Unix(0, start.UnixNano()/int64(split)*int64(split)).UTC()
+	for !from.After(end) {
+		to := from.Add(split)
+		intervals = append(intervals, cacheInterval{start: from, end: to})
+		from = to
+	}
+	return intervals
+}
+
+// cacheable reports whether an interval is old enough to be cached: data
+// near now may still be written and must always be fetched.
+func (c *queryCache) cacheable(iv cacheInterval, now time.Time) bool {
+	return iv.end.Before(now.Add(-c.freshness))
+}
+
+// cacheKey identifies an interval of a query within a scope. Tenant,
+// database and access policy are part of the key so that cached results
+// never leak across callers; source identifies the collections the interval
+// is read from, as given by partsSource.
+func cacheKey(scope *queryScope, query, source string, iv cacheInterval) string {
+	matchers := make([]string, 0, len(scope.Matchers))
+	for _, m := range scope.Matchers {
+		matchers = append(matchers, m.String())
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%d",
+		scope.Tenant, scope.Database, strings.Join(matchers, ","), query, source,
+		iv.start.UnixNano(), iv.end.UnixNano())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns a cached interval from memory, falling back to the persisted copy.
+func (c *queryCache) get(ctx context.Context, key string) ([]cachedSeries, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if now.Before(e.expiresAt) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e.series, true
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	if c.persist == "" {
+		return nil, false
+	}
+	var doc struct {
+		Series    []cachedSeries `bson:"series"`
+		ExpiresAt time.Time      `bson:"expiresAt"`
+	}
+	err := c.collection().FindOne(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$gt": now}}).Decode(&doc)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			loggerFromContext(ctx).Warn("Error reading cache entry", "err", err)
+		}
+		return nil, false
+	}
+	c.add(&cacheEntry{key: key, series: doc.Series, expiresAt: doc.ExpiresAt})
+	return doc.Series, true
+}
+
+// put caches an interval in memory and, if configured, in MongoDB.
+func (c *queryCache) put(ctx context.Context, key string, series []cachedSeries) {
+	e := &cacheEntry{key: key, series: series, expiresAt: time.Now().Add(c.ttl)}
+	c.add(e)
+	if c.persist == "" {
+		return
+	}
+	_, err := c.collection().ReplaceOne(ctx, bson.M{"_id": key},
+		bson.M{"_id": key, "series": series, "expiresAt": e.expiresAt},
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		loggerFromContext(ctx).Warn("Error persisting cache entry", "err", err)
+	}
+}
+
+func (c *queryCache) add(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// rangeQuery answers a range query interval by interval. With the results
+// cache enabled, completed intervals are taken from the cache and the rest is
+// fetched from MongoDB; cached intervals are fetched whole and trimmed to
+// [start, end], intervals that are too fresh to cache only for the queried
+// part. Each interval is read from the collections chosen by planRead, and
+// the response warns about samples that are rollup averages.
+func rangeQuery(ctx context.Context, scope *queryScope, query string, base translate.Read, collInfo CollectionInfo, start, end time.Time, step time.Duration) (map[string]interface{}, error) {
+	c := resultsCache
+	stats := queryStatsFromContext(ctx)
+	limits := scope.Limits
+	now := time.Now()
+	from, to := float64(start.UnixNano())/1e9, float64(end.UnixNano())/1e9
+	// Without a cache the query is a single interval; its end is exclusive,
+	// so one millisecond past end includes it.
+	intervals := []cacheInterval{{start: start, end: end.Add(time.Millisecond)}}
+	if c != nil {
+		intervals = c.splitRange(start, end, step)
+	}
+
+	merged := map[string]*cachedSeries{}
+	var order []string
+	// Rollup parts, merged across intervals, for the response warnings.
+	var rollups []readPart
+	fetched := 0
+	for _, iv := range intervals {
+		key := ""
+		cacheable := c != nil && c.cacheable(iv, now)
+		fetch := iv
+		if !cacheable {
+			// The interval end is exclusive; one millisecond past end includes it.
+			fetch = cacheInterval{start: laterOf(iv.start, start), end: earlierOf(iv.end, end.Add(time.Millisecond))}
+		}
+		parts := scope.planRead(collInfo, fetch.start, fetch.end, step, "")
+		for _, part := range parts {
+			if part.resolution > 0 {
+				rollups = mergeRollupPart(rollups, part)
+			}
+		}
+		series, hit := []cachedSeries(nil), false
+		if cacheable {
+			key = cacheKey(scope, query, partsSource(parts), iv)
+			series, hit = c.get(ctx, key)
+		}
+		if c != nil {
+			stats.addCacheResult(hit)
+		}
+		if !hit {
+			var n int
+			var err error
+			series, n, err = fetchInterval(ctx, scope, base, parts, limits.MaxDocuments-fetched)
+			if errors.Is(err, errLimitExceeded) {
+				return nil, fmt.Errorf("%w: more than %d documents scanned", errLimitExceeded, limits.MaxDocuments)
+			}
+			if err != nil {
+				return nil, err
+			}
+			fetched += n
+			if cacheable {
+				c.put(ctx, key, series)
+			}
+		}
+		for _, s := range series {
+			var ts []float64
+			var vs []string
+			for i, t := range s.Timestamps {
+				if t >= from && t <= to {
+					ts = append(ts, t)
+					vs = append(vs, s.Values[i])
+				}
+			}
+			if len(ts) == 0 {
+				continue
+			}
+			sig := createLabelSignature(s.Metric)
+			m, ok := merged[sig]
+			if !ok {
+				if limits.MaxSeries > 0 && len(merged) >= limits.MaxSeries {
+					return nil, fmt.Errorf("%w: more than %d series", errLimitExceeded, limits.MaxSeries)
+				}
+				m = &cachedSeries{Metric: s.Metric}
+				merged[sig] = m
+				order = append(order, sig)
+			}
+			m.Timestamps = append(m.Timestamps, ts...)
+			m.Values = append(m.Values, vs...)
+		}
+	}
+
+	result := make([]interface{}, 0, len(order))
+	for _, sig := range order {
+		s := merged[sig]
+		values := make([]interface{}, len(s.Timestamps))
+		for i := range s.Timestamps {
+			values[i] = []interface{}{s.Timestamps[i], s.Values[i]}
+		}
+		result = append(result, map[string]interface{}{"metric": s.Metric, "values": values})
+	}
+	results := map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": "matrix",
+			"result":     result,
+		},
+	}
+	if len(rollups) > 0 {
+		warnings := make([]string, 0, len(rollups))
+		for _, part := range rollups {
+			part.start, part.end = laterOf(part.start, start), earlierOf(part.end, end)
+			warnings = append(warnings, part.rollupWarning())
+		}
+		results["warnings"] = warnings
+	}
+	return results, nil
+}
+
+// fetchInterval reads one interval of the base read, returning its series and
+// the number of documents scanned. With a document limit configured, budget
+// is what is left of it for this query.
+func fetchInterval(ctx context.Context, scope *queryScope, base translate.Read, parts []readPart, budget int) ([]cachedSeries, int, error) {
+	logger := loggerFromContext(ctx)
+	stats := queryStatsFromContext(ctx)
+	bySig := map[string]int{}
+	var series []cachedSeries
+	scanned := 0
+	for _, part := range parts {
+		stats.addCollection(part.collInfo.Name)
+		cursor, err := dataBackend().Find(ctx, part.read(base))
+		if err != nil {
+			return nil, scanned, err
+		}
+		for cursor.Next(ctx) {
+			scanned++
+			stats.addDocs(1)
+			if scope.Limits.MaxDocuments > 0 && scanned > budget {
+				cursor.Close(ctx)
+				return nil, scanned, errLimitExceeded
+			}
+			var doc map[string]interface{}
+			if err := cursor.Decode(&doc); err != nil {
+				logger.Warn("Error decoding document", "err", err)
+				continue
+			}
+			timestamp, valueStr, metricLabels, err := part.collInfo.Extract(doc)
+			if err != nil {
+				if !errors.Is(err, translate.ErrDropped) {
+					logger.Warn("Error extracting data from doc", "err", err)
+				}
+				continue
+			}
+			sig := createLabelSignature(metricLabels)
+			i, ok := bySig[sig]
+			if !ok {
+				i = len(series)
+				bySig[sig] = i
+				series = append(series, cachedSeries{Metric: metricLabels})
+			}
+			series[i].Timestamps = append(series[i].Timestamps, timestamp)
+			series[i].Values = append(series[i].Values, valueStr)
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, scanned, fmt.Errorf("cursor error: %w", err)
+		}
+	}
+	return series, scanned, nil
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func earlierOf(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// subcommand is a command-line tool sharing the bridge configuration. It
+// returns the process exit code.
+type subcommand struct {
+	summary string
+	run     func(args []string) int
+}
+
+// subcommands are selected by the first command-line argument; without one
+// the bridge serves HTTP.
+var subcommands = map[string]subcommand{}
+
+func init() {
+	subcommands["indexes"] = subcommand{"check and create the indexes recommended for each collection", runIndexesCommand}
+	subcommands["validate"] = subcommand{"check the configuration and the fields of sampled documents", runValidateCommand}
+	subcommands["infer"] = subcommand{"propose a collection configuration from sampled documents", runInferCommand}
+	subcommands["translate"] = subcommand{"print the MongoDB query for a PromQL query", runTranslateCommand}
+	subcommands["export"] = subcommand{"write the samples of a selector as CSV, NDJSON or Parquet", runExportCommand}
+	subcommands["import"] = subcommand{"backfill samples from OpenMetrics files and Prometheus TSDB blocks", runImportCommand}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [-config config.yaml]\n       %s <command> [flags]\n\nCommands:\n", os.Args[0], os.Args[0])
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-10s %s\n", name, subcommands[name].summary)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// commandFlags returns a flag set for a subcommand with the shared -config flag.
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", "config.yaml", "Path to config file")
+	return fs, configFile
+}
+
+// commandConnect connects a subcommand to MongoDB and installs the client.
+func commandConnect(ctx context.Context) (*mongo.Client, error) {
+	if conf.MongoDB.Timeout <= 0 {
+		conf.MongoDB.Timeout = 10
+	}
+	c, err := connectMongo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	setMongoClient(c)
+	mongoHealthy.Store(true)
+	return c, nil
+}
+
+// commandContext is cancelled when a subcommand is interrupted.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
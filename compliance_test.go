@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+)
+
+// The PromQL compliance suite runs promqltest scripts (load and eval blocks,
+// see https://github.com/prometheus/prometheus/tree/main/promql/promqltest)
+// against the bridge. The series of the load blocks are written as documents
+// of complianceLayout into an in-memory store, and each eval is answered by
+// the PromQL engine twice: reading through the bridge, and reading
+// Prometheus' own storage holding the same series. The answers must agree.
+// The scripts' expected results are checked against Prometheus as well, so
+// a script cannot drift from what the upstream engine does.
+//
+// An eval directly preceded by a "# bridge: <reason>" comment is a known
+// difference. It must still disagree, so that fixing one shows up as a test
+// failure asking to remove the comment.
+//
+// PROMQL_COMPLIANCE_SCRIPTS may name further scripts (a glob, e.g. the
+// upstream testdata directory) to compare and report on without failing.
+
+const (
+	complianceDatabase = "promqltest"
+	knownDifference    = "# bridge:"
+)
+
+var complianceLayout = CollectionInfo{Collection: translate.Collection{
+	Name:        "samples",
+	TimeField:   "t",
+	MetricField: "name",
+	ValueField:  "v",
+	LabelsField: "labels",
+}}
+
+// As in promqltest.
+var (
+	patEvalInstant = regexp.MustCompile(`^eval(?:_(fail|warn|ordered|info))?\s+instant\s+(?:at\s+(.+?))?\s+(.+)$`)
+	patEvalRange   = regexp.MustCompile(`^eval(?:_(fail|warn|info))?\s+range\s+from\s+(.+)\s+to\s+(.+)\s+step\s+(.+?)\s+(.+)$`)
+)
+
+// complianceCase is one eval with the load blocks in effect for it.
+type complianceCase struct {
+	name    string // file:line of the eval
+	loads   string
+	expr    string
+	start   time.Time
+	end     time.Time // zero for instant queries
+	step    time.Duration
+	ordered bool
+	known   string // reason of a known difference
+}
+
+func TestPromQLCompliance(t *testing.T) {
+	scripts, err := filepath.Glob("testdata/promql/*.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runComplianceScripts(t, scripts, true)
+}
+
+func TestPromQLComplianceExtra(t *testing.T) {
+	pattern := os.Getenv("PROMQL_COMPLIANCE_SCRIPTS")
+	if pattern == "" {
+		t.Skip("PROMQL_COMPLIANCE_SCRIPTS is not set")
+	}
+	scripts, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runComplianceScripts(t, scripts, false)
+}
+
+// runComplianceScripts compares the bridge with Prometheus on every eval of
+// the scripts and logs how many agree. With strict set, the scripts must
+// pass against Prometheus and unexpected differences fail the test.
+func runComplianceScripts(t *testing.T, scripts []string, strict bool) {
+	engine := promqltest.NewTestEngine(t, false, 0, promqltest.DefaultMaxSamplesPerQuery)
+	agreed, total := 0, 0
+	for _, file := range scripts {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases, err := parseComplianceCases(filepath.Base(file), string(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			if strict {
+				promqltest.RunTest(t, string(content), engine)
+			}
+			for _, c := range cases {
+				total++
+				diff := compareWithPrometheus(t, engine, c)
+				switch {
+				case diff == "" && c.known != "":
+					agreed++
+					if strict {
+						t.Errorf("%s: agrees with Prometheus now; remove the %q comment (%s)", c.name, knownDifference, c.known)
+					}
+				case diff == "":
+					agreed++
+				case c.known != "":
+					t.Logf("%s: known difference (%s)", c.name, c.known)
+				case strict:
+					t.Errorf("%s: %s", c.name, diff)
+				default:
+					t.Logf("%s: %s", c.name, diff)
+				}
+			}
+		})
+	}
+	t.Logf("PromQL compliance: %d of %d evaluations agree with Prometheus", agreed, total)
+}
+
+// compareWithPrometheus evaluates a case against Prometheus' storage and the
+// bridge, describing how the answers differ; it returns "" if they agree.
+func compareWithPrometheus(t *testing.T, engine promql.QueryEngine, c complianceCase) string {
+	prom := promqltest.LoadedStorage(t, c.loads)
+	defer prom.Close()
+	bridge, err := newComplianceStorage(prom)
+	if err != nil {
+		t.Fatalf("%s: copying series: %v", c.name, err)
+	}
+	defer bridge.close()
+
+	want, wantErr := evalCase(engine, prom, c)
+	got, gotErr := evalCase(engine, bridge, c)
+	switch {
+	case wantErr != nil && gotErr != nil:
+		return ""
+	case wantErr != nil:
+		return fmt.Sprintf("%s: Prometheus fails with %v, the bridge returns\n%s", c.expr, wantErr, got)
+	case gotErr != nil:
+		return fmt.Sprintf("%s: the bridge fails with %v, Prometheus returns\n%s", c.expr, gotErr, want)
+	case want != got:
+		return fmt.Sprintf("%s: the bridge returns\n%s\nPrometheus returns\n%s", c.expr, got, want)
+	}
+	return ""
+}
+
+// evalCase runs a case's query and renders its result, sorting instant
+// vectors by labels unless the eval checks the order.
+func evalCase(engine promql.QueryEngine, q storage.Queryable, c complianceCase) (string, error) {
+	var query promql.Query
+	var err error
+	if c.end.IsZero() {
+		query, err = engine.NewInstantQuery(context.Background(), q, nil, c.expr, c.start)
+	} else {
+		query, err = engine.NewRangeQuery(context.Background(), q, nil, c.expr, c.start, c.end, c.step)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer query.Close()
+	res := query.Exec(context.Background())
+	if res.Err != nil {
+		return "", res.Err
+	}
+	if vec, ok := res.Value.(promql.Vector); ok && !c.ordered {
+		slices.SortFunc(vec, func(a, b promql.Sample) int { return labels.Compare(a.Metric, b.Metric) })
+	}
+	return res.Value.String(), nil
+}
+
+// parseComplianceCases splits a script into one case per eval. Commands are
+// separated by blank lines; clear drops the load blocks before it.
+func parseComplianceCases(name, script string) ([]complianceCase, error) {
+	var cases []complianceCase
+	var loads []string
+	var block []string
+	known, pending := "", ""
+	flush := func(line int) error {
+		defer func() { block, known = nil, "" }()
+		if len(block) == 0 {
+			return nil
+		}
+		cmd := block[0]
+		switch {
+		case strings.HasPrefix(cmd, "load"):
+			loads = append(loads, strings.Join(block, "\n"))
+		case strings.HasPrefix(cmd, "eval"):
+			c, err := parseEval(cmd)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, line-len(block), err)
+			}
+			c.name = fmt.Sprintf("%s:%d", name, line-len(block))
+			c.loads = strings.Join(loads, "\n\n") + "\n"
+			c.known = known
+			cases = append(cases, c)
+		case cmd == "clear":
+			loads = nil
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(script))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		switch {
+		case trimmed == "":
+			if err := flush(line); err != nil {
+				return nil, err
+			}
+			pending = ""
+		case strings.HasPrefix(trimmed, "#"):
+			if len(block) == 0 && strings.HasPrefix(trimmed, knownDifference) {
+				pending = strings.TrimSpace(strings.TrimPrefix(trimmed, knownDifference))
+			}
+		case len(block) > 0 && text[0] != ' ' && text[0] != '\t' && isCommand(trimmed):
+			// A command right after another one, without a blank line.
+			if err := flush(line); err != nil {
+				return nil, err
+			}
+			fallthrough
+		default:
+			if len(block) == 0 {
+				known, pending = pending, ""
+			}
+			block = append(block, text)
+		}
+	}
+	if err := flush(line + 1); err != nil {
+		return nil, err
+	}
+	return cases, scanner.Err()
+}
+
+func isCommand(line string) bool {
+	return strings.HasPrefix(line, "load") || strings.HasPrefix(line, "eval") || line == "clear"
+}
+
+// parseEval reads the query and times of an eval command.
+func parseEval(cmd string) (complianceCase, error) {
+	var c complianceCase
+	if m := patEvalInstant.FindStringSubmatch(cmd); m != nil {
+		at, err := scriptTime(m[2])
+		if err != nil {
+			return c, err
+		}
+		c.expr, c.start, c.ordered = m[3], at, m[1] == "ordered"
+		return c, nil
+	}
+	if m := patEvalRange.FindStringSubmatch(cmd); m != nil {
+		from, err := scriptTime(m[2])
+		if err != nil {
+			return c, err
+		}
+		to, err := scriptTime(m[3])
+		if err != nil {
+			return c, err
+		}
+		step, err := model.ParseDuration(m[4])
+		if err != nil {
+			return c, err
+		}
+		c.expr, c.start, c.end, c.step = m[5], from, to, time.Duration(step)
+		// A range ending at the epoch would read as an instant query.
+		if c.end.IsZero() {
+			return c, fmt.Errorf("unsupported range ending at 0: %s", cmd)
+		}
+		return c, nil
+	}
+	return c, fmt.Errorf("invalid eval command: %s", cmd)
+}
+
+// scriptTime is a time of a script: a duration since the epoch.
+func scriptTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, 0).UTC().Add(time.Duration(d)), nil
+}
+
+// complianceStorage is the bridge reading a fresh in-memory store.
+type complianceStorage struct {
+	mongoQueryable
+}
+
+// newComplianceStorage copies the series of a Prometheus storage into an
+// in-memory store, mapping every metric to complianceLayout, and returns
+// the bridge's storage over it.
+func newComplianceStorage(from storage.Queryable) (*complianceStorage, error) {
+	backendOverride = translate.NewMemory()
+	s := &complianceStorage{mongoQueryable{scope: &queryScope{
+		Database:    complianceDatabase,
+		Collections: map[string]CollectionInfo{complianceLayout.Name: complianceLayout},
+		Mappings:    map[string]Mapping{},
+	}}}
+
+	ctx := context.Background()
+	querier, err := from.Querier(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	defer querier.Close()
+	set := querier.Select(ctx, false, nil, labels.MustNewMatcher(labels.MatchRegexp, model.MetricNameLabel, ".+"))
+	app := mongoAppendable{database: complianceDatabase, collInfo: complianceLayout}.Appender(ctx)
+	for set.Next() {
+		series := set.At()
+		s.scope.Mappings[series.Labels().Get(model.MetricNameLabel)] = Mapping{Collection: complianceLayout.Name}
+		it := series.Iterator(nil)
+		for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+			if vt != chunkenc.ValFloat {
+				continue // only float samples can be stored
+			}
+			ts, v := it.At()
+			if _, err := app.Append(0, series.Labels(), ts, v); err != nil {
+				return nil, err
+			}
+		}
+		if it.Err() != nil {
+			return nil, it.Err()
+		}
+	}
+	if set.Err() != nil {
+		return nil, set.Err()
+	}
+	return s, app.Commit()
+}
+
+func (s *complianceStorage) close() {
+	backendOverride = nil
+}
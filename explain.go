@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// handleExplain serves /api/v1/explain: the query endpoint in explain mode.
+// It accepts the same parameters as a query or range query.
+func handleExplain(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	q.Set("explain", "1")
+	r.URL.RawQuery = q.Encode()
+	handleQuery(w, r)
+}
+
+// explainRequested reports whether a query asks for explain mode (?explain=1).
+func explainRequested(r *http.Request) bool {
+	switch r.URL.Query().Get("explain") {
+	case "1", "true":
+		return true
+	}
+	return false
+}
+
+// queryPlan returns the reads handleQuery performs for the translated read
+// of a selector: the read itself or, for range queries going through
+// rangeQuery, one read per rollup or raw part chosen by planRead.
+func queryPlan(scope *queryScope, read translate.Read, collInfo CollectionInfo, isRange bool, step time.Duration) []translate.Read {
+	if !isRange || (resultsCache == nil && len(collInfo.Rollups) == 0) {
+		return []translate.Read{read}
+	}
+	var reads []translate.Read
+	for _, part := range scope.planRead(collInfo, read.Start, read.End, step, "") {
+		reads = append(reads, part.read(read))
+	}
+	return reads
+}
+
+// explainQuery answers an explain request: the parsed AST, the reads that
+// would be sent to MongoDB and MongoDB's executionStats explain of each.
+func explainQuery(ctx context.Context, w http.ResponseWriter, query string, scope *queryScope, reads []translate.Read) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	db := mongoClient().Database(scope.Database)
+	explained := make([]interface{}, 0, len(reads))
+	for _, read := range reads {
+		filter := translate.Filter(read)
+		filterJSON, err := bson.MarshalExtJSON(filter, false, false)
+		if err != nil {
+			sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		entry := map[string]interface{}{
+			"database":   scope.Database,
+			"collection": read.Collection.Name,
+			"filter":     json.RawMessage(filterJSON),
+		}
+		var raw bson.Raw
+		err = db.RunCommand(ctx, bson.D{
+			{Key: "explain", Value: bson.D{{Key: "find", Value: read.Collection.Name}, {Key: "filter", Value: filter}}},
+			{Key: "verbosity", Value: "executionStats"},
+		}).Decode(&raw)
+		if err != nil {
+			entry["error"] = err.Error()
+			explained = append(explained, entry)
+			continue
+		}
+		if out, err := bson.MarshalExtJSON(raw, false, false); err == nil {
+			entry["explain"] = json.RawMessage(out)
+		}
+		entry["summary"] = explainSummary(raw)
+		explained = append(explained, entry)
+	}
+	sendJSON(w, map[string]interface{}{
+		"query":        query,
+		"ast":          astJSON(expr),
+		"tree":         parser.Tree(expr),
+		"resultsCache": resultsCache != nil,
+		"reads":        explained,
+	})
+}
+
+// astJSON renders a PromQL AST node and its children.
+func astJSON(node parser.Node) map[string]interface{} {
+	out := map[string]interface{}{
+		"type": strings.TrimPrefix(fmt.Sprintf("%T", node), "*parser."),
+		"expr": node.String(),
+	}
+	if vs, ok := node.(*parser.VectorSelector); ok {
+		matchers := make([]string, 0, len(vs.LabelMatchers))
+		for _, m := range vs.LabelMatchers {
+			matchers = append(matchers, m.String())
+		}
+		out["matchers"] = matchers
+	}
+	var children []interface{}
+	for _, c := range parser.Children(node) {
+		children = append(children, astJSON(c))
+	}
+	if len(children) > 0 {
+		out["children"] = children
+	}
+	return out
+}
+
+// explainSummary extracts the figures that matter most from an explain
+// result: documents and keys examined, results, time and the indexes used.
+func explainSummary(raw bson.Raw) map[string]interface{} {
+	summary := map[string]interface{}{}
+	if stats, ok := raw.Lookup("executionStats").DocumentOK(); ok {
+		for _, k := range []string{"nReturned", "totalDocsExamined", "totalKeysExamined", "executionTimeMillis"} {
+			if v, ok := stats.Lookup(k).AsInt64OK(); ok {
+				summary[k] = v
+			}
+		}
+	}
+	var stages, indexes []string
+	if plan, ok := raw.Lookup("queryPlanner", "winningPlan").DocumentOK(); ok {
+		walkPlan(plan, &stages, &indexes)
+	}
+	summary["stages"] = stages
+	summary["indexesUsed"] = indexes
+	summary["collectionScan"] = slices.Contains(stages, "COLLSCAN")
+	return summary
+}
+
+// walkPlan collects the stage names and index names of a query plan tree.
+func walkPlan(plan bson.Raw, stages, indexes *[]string) {
+	if s, ok := plan.Lookup("stage").StringValueOK(); ok {
+		*stages = append(*stages, s)
+	}
+	if name, ok := plan.Lookup("indexName").StringValueOK(); ok {
+		*indexes = append(*indexes, name)
+	}
+	// Newer servers wrap the classic plan in queryPlan.
+	if sub, ok := plan.Lookup("queryPlan").DocumentOK(); ok {
+		walkPlan(sub, stages, indexes)
+	}
+	if sub, ok := plan.Lookup("inputStage").DocumentOK(); ok {
+		walkPlan(sub, stages, indexes)
+	}
+	if arr, ok := plan.Lookup("inputStages").ArrayOK(); ok {
+		values, _ := arr.Values()
+		for _, v := range values {
+			if sub, ok := v.DocumentOK(); ok {
+				walkPlan(sub, stages, indexes)
+			}
+		}
+	}
+}
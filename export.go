@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+)
+
+// exportContentTypes are the export formats and their content types.
+var exportContentTypes = map[string]string{
+	"csv":     "text/csv; charset=utf-8",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// handleExport serves /api/v1/export: the raw samples of a selector between
+// start and end, both inclusive, streamed as CSV, NDJSON or Parquet
+// (format=csv, the default, ndjson or parquet).
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+	selector := r.FormValue("match[]")
+	if selector == "" {
+		selector = r.FormValue("query")
+	}
+	if selector == "" {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", "no selector given, set match[] or query")
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	if _, ok := exportContentTypes[format]; !ok {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("unknown format %q", format))
+		return
+	}
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid start time: %v", err))
+		return
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid end time: %v", err))
+		return
+	}
+	scope, err := resolveScope(r)
+	if err != nil {
+		sendScopeError(w, err)
+		return
+	}
+	reads, err := exportReads(scope, selector, start, end)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+
+	// Exports stream for as long as they take, bounded by maxDocuments rather
+	// than the server write timeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	stats := &queryStats{}
+	ctx := withScope(withQueryStats(r.Context(), stats), scope)
+	scanned := 0
+	columns, err := exportColumns(ctx, reads, &scanned)
+	if errors.Is(err, errLimitExceeded) {
+		sendJSONError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+		return
+	}
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=export.%s", format))
+	// Headers are sent with the first row, so errors from here on can only
+	// cut the response short.
+	if err := exportSamples(ctx, reads, newExporter(w, format, columns), &scanned); err != nil {
+		logger.Error("Export failed", "err", err)
+	}
+}
+
+// runExportCommand implements the "export" subcommand: it writes the samples
+// of a selector between -start and -end to a file or standard output.
+func runExportCommand(args []string) int {
+	fs, configFile := commandFlags("export")
+	selector := fs.String("query", "", "Series selector (required)")
+	start := fs.String("start", "", "Start, Unix seconds or RFC3339 (required)")
+	end := fs.String("end", "", "End, Unix seconds or RFC3339 (required)")
+	format := fs.String("format", "csv", "Output format: csv, ndjson or parquet")
+	output := fs.String("output", "-", "Output file, - for standard output")
+	tenant := fs.String("tenant", "", "Tenant ID, when multi-tenancy is enabled")
+	principal := fs.String("principal", "", "Authenticated user or token name whose access policy applies")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *selector == "" {
+		fmt.Fprintln(os.Stderr, "export: -query is required")
+		return 2
+	}
+	if _, ok := exportContentTypes[*format]; !ok {
+		fmt.Fprintf(os.Stderr, "export: unknown format %q\n", *format)
+		return 2
+	}
+	startTime, err := parseTime(*start)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export: invalid -start:", err)
+		return 2
+	}
+	endTime, err := parseTime(*end)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export: invalid -end:", err)
+		return 2
+	}
+	if err := loadConfig(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := loadAccessPolicies(conf.AccessPolicies); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	scope, err := commandScope(*tenant, *principal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+	reads, err := exportReads(scope, *selector, startTime, endTime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	client, err := commandConnect(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "connecting to MongoDB:", err)
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, "export:", err)
+			return 1
+		}
+		defer out.Close()
+	}
+	ctx = withScope(withQueryStats(ctx, &queryStats{}), scope)
+	scanned := 0
+	columns, err := exportColumns(ctx, reads, &scanned)
+	if err == nil {
+		err = exportSamples(ctx, reads, newExporter(out, *format, columns), &scanned)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+	return 0
+}
+
+// exportReads plans the reads of a selector between start and end, both
+// inclusive.
+func exportReads(scope *queryScope, selector string, start, end time.Time) ([]translate.Read, error) {
+	if end.Before(start) {
+		return nil, errors.New("end time must not be before start time")
+	}
+	if err := scope.checkRange(start, end); err != nil {
+		return nil, err
+	}
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := scope.translator().Select(matchers, start, end.Add(time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	return plan.Reads, nil
+}
+
+// exportColumns returns the label columns of an export, __name__ first and
+// the others sorted. The labels of collections with a labels subdocument or
+// relabeling are only known from the documents, which are read once for
+// their label names; those documents count towards scanned too.
+func exportColumns(ctx context.Context, reads []translate.Read, scanned *int) ([]string, error) {
+	seen := map[string]bool{}
+	for _, read := range reads {
+		if read.Collection.LabelsField == "" && len(read.Collection.RelabelConfigs) == 0 {
+			for _, l := range read.Collection.LabelNames() {
+				seen[l] = true
+			}
+			continue
+		}
+		err := scanSamples(ctx, read, scanned, func(_, _ float64, lbls map[string]string) error {
+			for l := range lbls {
+				seen[l] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	delete(seen, model.MetricNameLabel)
+	return append([]string{model.MetricNameLabel}, sortedKeys(seen)...), nil
+}
+
+// exportSamples streams the samples of the reads to an exporter, document
+// by document.
+func exportSamples(ctx context.Context, reads []translate.Read, e exporter, scanned *int) error {
+	for _, read := range reads {
+		err := scanSamples(ctx, read, scanned, func(timestamp, value float64, lbls map[string]string) error {
+			return e.write(time.UnixMilli(int64(math.Round(timestamp*1000))).UTC(), value, lbls)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return e.close()
+}
+
+// scanSamples calls fn for every sample of a read, skipping documents that
+// cannot be read and staleness markers. Documents are counted in scanned,
+// shared by all reads of an export, against the scope's document limit.
+func scanSamples(ctx context.Context, read translate.Read, scanned *int, fn func(timestamp, value float64, lbls map[string]string) error) error {
+	logger := loggerFromContext(ctx)
+	stats := queryStatsFromContext(ctx)
+	limits := scopeFromContext(ctx).Limits
+	stats.addCollection(read.Collection.Name)
+	cursor, err := dataBackend().Find(ctx, read)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		stats.addDocs(1)
+		*scanned++
+		if limits.MaxDocuments > 0 && *scanned > limits.MaxDocuments {
+			return fmt.Errorf("%w: more than %d documents scanned", errLimitExceeded, limits.MaxDocuments)
+		}
+		var doc translate.Document
+		if err := cursor.Decode(&doc); err != nil {
+			logger.Warn("Error decoding document", "err", err)
+			continue
+		}
+		timestamp, v, lbls, err := read.Collection.ExtractSample(doc)
+		if err != nil {
+			if !errors.Is(err, translate.ErrDropped) {
+				logger.Warn("Error extracting data from doc", "err", err)
+			}
+			continue
+		}
+		if value.IsStaleNaN(v) {
+			continue
+		}
+		if err := fn(timestamp, v, lbls); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// exporter writes samples in one of the export formats.
+type exporter interface {
+	write(t time.Time, value float64, lbls map[string]string) error
+	close() error
+}
+
+// newExporter returns the exporter of a format. CSV and Parquet have a
+// column per label, then timestamp and value; a label named like one of
+// those gets a "label_" prefix.
+func newExporter(w io.Writer, format string, columns []string) exporter {
+	switch format {
+	case "ndjson":
+		return &ndjsonExporter{enc: json.NewEncoder(w)}
+	case "parquet":
+		return newParquetExporter(w, columns)
+	}
+	return &csvExporter{w: csv.NewWriter(w), columns: columns}
+}
+
+// exportColumnName is the column of a label in CSV and Parquet exports.
+func exportColumnName(label string) string {
+	if label == "timestamp" || label == "value" {
+		return "label_" + label
+	}
+	return label
+}
+
+type csvExporter struct {
+	w       *csv.Writer
+	columns []string
+	started bool
+}
+
+func (e *csvExporter) writeHeader() error {
+	e.started = true
+	header := make([]string, 0, len(e.columns)+2)
+	for _, c := range e.columns {
+		header = append(header, exportColumnName(c))
+	}
+	return e.w.Write(append(header, "timestamp", "value"))
+}
+
+func (e *csvExporter) write(t time.Time, value float64, lbls map[string]string) error {
+	if !e.started {
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+	record := make([]string, 0, len(e.columns)+2)
+	for _, c := range e.columns {
+		record = append(record, lbls[c])
+	}
+	return e.w.Write(append(record, t.Format(time.RFC3339Nano), translate.FormatValue(value)))
+}
+
+func (e *csvExporter) close() error {
+	if !e.started {
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonExporter writes a line {"metric": {...}, "timestamp": "...",
+// "value": "..."} per sample; the value is a string as in the query API.
+type ndjsonExporter struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExporter) write(t time.Time, value float64, lbls map[string]string) error {
+	return e.enc.Encode(map[string]interface{}{
+		"metric":    lbls,
+		"timestamp": t.Format(time.RFC3339Nano),
+		"value":     translate.FormatValue(value),
+	})
+}
+
+func (e *ndjsonExporter) close() error { return nil }
+
+// parquetExporter writes a Parquet file with an optional string column per
+// label, a millisecond timestamp and a double value.
+type parquetExporter struct {
+	w      *parquet.Writer
+	leaves []string // label of each leaf column in schema order, "" for timestamp and value
+	labels map[string]string
+	row    parquet.Row
+}
+
+func newParquetExporter(w io.Writer, columns []string) *parquetExporter {
+	group := parquet.Group{
+		"timestamp": parquet.Timestamp(parquet.Millisecond),
+		"value":     parquet.Leaf(parquet.DoubleType),
+	}
+	labelOf := map[string]string{}
+	for _, c := range columns {
+		group[exportColumnName(c)] = parquet.Optional(parquet.String())
+		labelOf[exportColumnName(c)] = c
+	}
+	schema := parquet.NewSchema("export", group)
+	e := &parquetExporter{w: parquet.NewWriter(w, schema), labels: labelOf}
+	for _, path := range schema.Columns() {
+		e.leaves = append(e.leaves, path[0])
+	}
+	return e
+}
+
+func (e *parquetExporter) write(t time.Time, value float64, lbls map[string]string) error {
+	e.row = e.row[:0]
+	for i, column := range e.leaves {
+		switch column {
+		case "timestamp":
+			e.row = append(e.row, parquet.Int64Value(t.UnixMilli()).Level(0, 0, i))
+		case "value":
+			e.row = append(e.row, parquet.DoubleValue(value).Level(0, 0, i))
+		default:
+			if v, ok := lbls[e.labels[column]]; ok {
+				e.row = append(e.row, parquet.ByteArrayValue([]byte(v)).Level(0, 1, i))
+			} else {
+				e.row = append(e.row, parquet.NullValue().Level(0, 0, i))
+			}
+		}
+	}
+	_, err := e.w.WriteRows([]parquet.Row{e.row})
+	return err
+}
+
+func (e *parquetExporter) close() error { return e.w.Close() }
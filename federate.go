@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"google.golang.org/protobuf/proto"
+)
+
+// federateLookback bounds how old the latest sample of a federated series
+// may be, like the default lookback delta of Prometheus federation.
+const federateLookback = 5 * time.Minute
+
+// handleFederate serves /federate: the latest sample of every series
+// matching one of the match[] selectors, in the Prometheus text format or
+// OpenMetrics, with timestamps. Series are untyped unless their mapping
+// declares them a counter or gauge.
+func handleFederate(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+	if err := r.ParseForm(); err != nil {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("error parsing form values: %v", err))
+		return
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", "no match[] parameter given")
+		return
+	}
+	var matcherSets [][]*labels.Matcher
+	for _, s := range selectors {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			sendJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	scope, err := resolveScope(r)
+	if err != nil {
+		sendScopeError(w, err)
+		return
+	}
+
+	stats := &queryStats{}
+	// Reads stop when the server could no longer send the response anyway.
+	timeout := secondsOr(conf.Server.WriteTimeout, defaultWriteTimeout)
+	ctx, cancel := context.WithTimeout(withScope(withQueryStats(r.Context(), stats), scope), timeout)
+	defer cancel()
+	latestPoints := map[string]map[string]interface{}{}
+	scanned := 0 // documents scanned across all match[] selectors
+	start := time.Now().Add(-federateLookback)
+	for _, matchers := range matcherSets {
+		plan, err := scope.translator().Select(matchers, start, time.Time{})
+		if err != nil {
+			sendJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		for _, read := range plan.Reads {
+			collInfo := scope.Collections[read.Key]
+			stats.addCollection(collInfo.Name)
+			cursor, err := dataBackend().Find(ctx, read)
+			if err != nil {
+				sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+				return
+			}
+			err = latestSamples(ctx, cursor, collInfo, latestPoints, &scanned)
+			cursor.Close(ctx)
+			if errors.Is(err, errLimitExceeded) {
+				sendJSONError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+				return
+			}
+			if err != nil {
+				sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+				return
+			}
+		}
+	}
+
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	enc := expfmt.NewEncoder(w, format, expfmt.WithUnit())
+	for _, family := range metricFamilies(latestPoints, scope.Mappings) {
+		if err := enc.Encode(family); err != nil {
+			logger.Error("Error encoding federated metrics", "family", family.GetName(), "err", err)
+			return
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error("Error finishing federated metrics", "err", err)
+		}
+	}
+}
+
+// metricFamilies groups latest points as collected by latestSamples into
+// metric families sorted by name, with series sorted by labels.
+func metricFamilies(latestPoints map[string]map[string]interface{}, mappings map[string]Mapping) []*dto.MetricFamily {
+	byName := map[string][]labels.Labels{}
+	samples := map[string][]interface{}{}
+	for _, point := range latestPoints {
+		lset := labels.FromMap(point["metric"].(map[string]string))
+		name := lset.Get(model.MetricNameLabel)
+		byName[name] = append(byName[name], lset)
+		samples[lset.String()] = point["value"].([]interface{})
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, name := range sortedKeys(byName) {
+		m := mappings[name]
+		family := &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_UNTYPED.Enum()}
+		switch m.Type {
+		case "counter":
+			family.Type = dto.MetricType_COUNTER.Enum()
+		case "gauge":
+			family.Type = dto.MetricType_GAUGE.Enum()
+		}
+		if m.Help != "" {
+			family.Help = proto.String(m.Help)
+		}
+		// OpenMetrics requires the name (of a counter, without _total) to end
+		// with the unit; the encoder would otherwise append it and rename the
+		// series, so other units are left out.
+		unitName := name
+		if family.GetType() == dto.MetricType_COUNTER {
+			unitName = strings.TrimSuffix(name, "_total")
+		}
+		if m.Unit != "" && family.GetType() != dto.MetricType_UNTYPED && strings.HasSuffix(unitName, "_"+m.Unit) {
+			family.Unit = proto.String(m.Unit)
+		}
+
+		series := byName[name]
+		sort.Slice(series, func(i, j int) bool { return labels.Compare(series[i], series[j]) < 0 })
+		for _, lset := range series {
+			sample := samples[lset.String()]
+			v, err := strconv.ParseFloat(sample[1].(string), 64)
+			if err != nil {
+				continue
+			}
+			metric := &dto.Metric{TimestampMs: proto.Int64(int64(math.Round(sample[0].(float64) * 1000)))}
+			lset.Range(func(l labels.Label) {
+				if l.Name != model.MetricNameLabel {
+					metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+				}
+			})
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				metric.Counter = &dto.Counter{Value: proto.Float64(v)}
+			case dto.MetricType_GAUGE:
+				metric.Gauge = &dto.Gauge{Value: proto.Float64(v)}
+			default:
+				metric.Untyped = &dto.Untyped{Value: proto.Float64(v)}
+			}
+			family.Metric = append(family.Metric, metric)
+		}
+		families = append(families, family)
+	}
+	return families
+}
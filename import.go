@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+)
+
+const (
+	defaultImportBatchSize = 1000
+	defaultImportProgress  = 10 * time.Second
+)
+
+// runImportCommand implements the "import" subcommand: it backfills samples
+// from OpenMetrics or Prometheus text files and Prometheus TSDB blocks or data
+// directories into the collections the mappings select. Samples are upserted
+// on their labels and timestamp, so an interrupted import can be run again.
+func runImportCommand(args []string) int {
+	fs, configFile := commandFlags("import")
+	batchSize := fs.Int("batch-size", defaultImportBatchSize, "Documents written per request")
+	fallback := fs.String("collection", "", "Collection key for metrics without a mapping; they are skipped if unset")
+	tenant := fs.String("tenant", "", "Tenant ID, when multi-tenancy is enabled")
+	progress := fs.Duration("progress", defaultImportProgress, "Interval between progress reports, 0 to disable")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [flags] <file or TSDB directory>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *batchSize <= 0 {
+		fmt.Fprintln(os.Stderr, "import: -batch-size must be positive")
+		return 2
+	}
+	if err := loadConfig(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	scope, err := commandScope(*tenant, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	if _, ok := scope.Collections[*fallback]; *fallback != "" && !ok {
+		fmt.Fprintf(os.Stderr, "import: -collection %q is not a configured collection\n", *fallback)
+		return 2
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	client, err := commandConnect(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "connecting to MongoDB:", err)
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+
+	im := newImporter(ctx, scope, *fallback, *batchSize)
+	if *progress > 0 {
+		im.progress, im.interval = os.Stderr, *progress
+	}
+	for _, path := range fs.Args() {
+		if err := im.importPath(path); err != nil {
+			fmt.Fprintf(os.Stderr, "import: %s: %v\n", path, err)
+			im.report(os.Stderr)
+			return 1
+		}
+	}
+	if err := im.flushAll(); err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	im.report(os.Stdout)
+	return 0
+}
+
+// importer batches samples into documents per collection and upserts them.
+type importer struct {
+	ctx       context.Context
+	scope     *queryScope
+	fallback  string // collection key for unmapped metrics
+	batchSize int
+
+	keys     map[string]string               // metric name -> collection key
+	pending  map[string][]translate.Document // collection key -> documents
+	series   map[string]bool                 // label sets imported so far
+	unmapped map[string]bool                 // metric names skipped for lack of a mapping
+	stray    map[string]bool                 // series skipped for labels their collection cannot store
+	samples  int
+	skipped  int // staleness markers and histogram samples
+
+	progress   io.Writer
+	interval   time.Duration
+	began      time.Time
+	lastReport time.Time
+}
+
+func newImporter(ctx context.Context, scope *queryScope, fallback string, batchSize int) *importer {
+	return &importer{
+		ctx:       ctx,
+		scope:     scope,
+		fallback:  fallback,
+		batchSize: batchSize,
+		keys:      mappingKeys(scope.Mappings),
+		pending:   map[string][]translate.Document{},
+		series:    map[string]bool{},
+		unmapped:  map[string]bool{},
+		stray:     map[string]bool{},
+		began:     time.Now(),
+	}
+}
+
+// importPath imports a TSDB block, a TSDB data directory or a text file.
+func (im *importer) importPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return im.importText(path)
+	}
+	if _, err := os.Stat(filepath.Join(path, "meta.json")); err == nil {
+		return im.importBlock(path)
+	}
+	return im.importDataDir(path)
+}
+
+// importText imports an OpenMetrics file, recognised by its "# EOF" line, or
+// a file in the Prometheus text format. Every sample needs a timestamp.
+func (im *importer) importText(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var p textparse.Parser
+	if bytes.HasSuffix(bytes.TrimSpace(b), []byte("# EOF")) {
+		p = textparse.NewOpenMetricsParser(b, labels.NewSymbolTable(), textparse.WithOMParserCTSeriesSkipped())
+	} else {
+		p = textparse.NewPromParser(b, labels.NewSymbolTable())
+	}
+	var lset labels.Labels
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch entry {
+		case textparse.EntrySeries:
+			series, ts, v := p.Series()
+			if ts == nil {
+				return fmt.Errorf("sample %s has no timestamp", series)
+			}
+			p.Labels(&lset)
+			if err := im.add(lset, *ts, v); err != nil {
+				return err
+			}
+		case textparse.EntryHistogram:
+			im.skipped++
+		}
+	}
+}
+
+// importBlock imports the float samples of one TSDB block.
+func (im *importer) importBlock(dir string) error {
+	block, err := tsdb.OpenBlock(slog.New(slog.DiscardHandler), dir, nil, tsdb.DefaultPostingsDecoderFactory)
+	if err != nil {
+		return err
+	}
+	defer block.Close()
+	q, err := tsdb.NewBlockQuerier(block, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	return im.importQuerier(q)
+}
+
+// importDataDir imports a Prometheus data directory read-only: its blocks
+// and the samples still in its write-ahead log. The log is replayed in a
+// temporary directory.
+func (im *importer) importDataDir(dir string) error {
+	sandbox, err := os.MkdirTemp("", "promql2mongo-import")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(sandbox)
+	db, err := tsdb.OpenDBReadOnly(dir, sandbox, slog.New(slog.DiscardHandler))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	q, err := db.Querier(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	return im.importQuerier(q)
+}
+
+func (im *importer) importQuerier(q storage.Querier) error {
+	set := q.Select(im.ctx, false, nil, labels.MustNewMatcher(labels.MatchRegexp, model.MetricNameLabel, ".+"))
+	var it chunkenc.Iterator
+	for set.Next() {
+		series := set.At()
+		it = series.Iterator(it)
+		for typ := it.Next(); typ != chunkenc.ValNone; typ = it.Next() {
+			if typ != chunkenc.ValFloat {
+				im.skipped++
+				continue
+			}
+			t, v := it.At()
+			if err := im.add(series.Labels(), t, v); err != nil {
+				return err
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return set.Err()
+}
+
+// add queues a sample for the collection of its metric, writing the batch
+// when it is full.
+func (im *importer) add(l labels.Labels, t int64, v float64) error {
+	if err := im.ctx.Err(); err != nil {
+		return err
+	}
+	if value.IsStaleNaN(v) {
+		im.skipped++
+		return nil
+	}
+	name := l.Get(model.MetricNameLabel)
+	key, ok := im.keys[name]
+	if !ok {
+		key = im.fallback
+	}
+	collInfo, ok := im.scope.Collections[key]
+	if !ok {
+		im.unmapped[name] = true
+		return nil
+	}
+	// Stored as top-level fields, such labels would be part of the upsert
+	// key but never read back, merging distinct series on queries.
+	if stray := strayLabels(l, collInfo); len(stray) > 0 {
+		im.stray[l.String()] = true
+		if len(im.stray) == 1 {
+			slog.Warn("Skipping series with labels their collection cannot store; the report counts them", "series", l.String(), "collection", key, "labels", stray)
+		}
+		return nil
+	}
+	doc := sampleToDoc(l, t, v, collInfo)
+	for field, fieldValue := range im.scope.Fields {
+		doc[field] = fieldValue
+	}
+	im.pending[key] = append(im.pending[key], doc)
+	im.series[l.String()] = true
+	im.samples++
+	if len(im.pending[key]) >= im.batchSize {
+		if err := im.flush(key); err != nil {
+			return err
+		}
+	}
+	if im.progress != nil && time.Since(im.lastReport) >= im.interval {
+		im.lastReport = time.Now()
+		im.report(im.progress)
+	}
+	return nil
+}
+
+// flush upserts the pending documents of a collection.
+func (im *importer) flush(key string) error {
+	docs := im.pending[key]
+	if len(docs) == 0 {
+		return nil
+	}
+	collInfo := im.scope.Collections[key]
+	if err := dataBackend().Upsert(im.ctx, im.scope.Database, collInfo.Name, collInfo.ValueField, docs...); err != nil {
+		return fmt.Errorf("writing to %s: %w", collInfo.Name, err)
+	}
+	im.pending[key] = docs[:0]
+	return nil
+}
+
+func (im *importer) flushAll() error {
+	for _, key := range sortedKeys(im.pending) {
+		if err := im.flush(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// report prints the number of samples and series imported so far.
+func (im *importer) report(w io.Writer) {
+	elapsed := time.Since(im.began)
+	fmt.Fprintf(w, "%d samples of %d series imported in %s (%.0f samples/s)",
+		im.samples, len(im.series), elapsed.Round(time.Second), float64(im.samples)/max(elapsed.Seconds(), 1e-3))
+	if im.skipped > 0 {
+		fmt.Fprintf(w, ", %d staleness markers or histogram samples skipped", im.skipped)
+	}
+	if len(im.unmapped) > 0 {
+		fmt.Fprintf(w, ", %d unmapped metrics skipped", len(im.unmapped))
+	}
+	if len(im.stray) > 0 {
+		fmt.Fprintf(w, ", %d series skipped for labels without a labelFields entry in a collection without labelsField", len(im.stray))
+	}
+	fmt.Fprintln(w)
+}
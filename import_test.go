@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+)
+
+func TestImporterStrayLabels(t *testing.T) {
+	defer func() { backendOverride = nil }()
+	mem := translate.NewMemory()
+	backendOverride = mem
+	flat := CollectionInfo{Collection: translate.Collection{
+		Name: "flat", TimeField: "ts", MetricField: "name", ValueField: "value",
+		LabelFields: map[string]string{"host": "host"},
+	}}
+	scope := &queryScope{Database: "db", Collections: map[string]CollectionInfo{"flat": flat}, Mappings: map[string]Mapping{"up": {Collection: "flat"}}}
+	im := newImporter(context.Background(), scope, "", 10)
+	for _, l := range []labels.Labels{
+		labels.FromStrings("__name__", "up", "host", "a"),
+		labels.FromStrings("__name__", "up", "host", "a", "zone", "z1"),
+		labels.FromStrings("__name__", "up", "host", "a", "zone", "z2"),
+	} {
+		for ts := int64(0); ts < 2; ts++ {
+			if err := im.add(l, ts*1000, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := im.flushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if im.samples != 2 || len(im.series) != 1 || len(im.stray) != 2 {
+		t.Errorf("got %d samples of %d series, %d stray series", im.samples, len(im.series), len(im.stray))
+	}
+	var out bytes.Buffer
+	im.report(&out)
+	if !strings.Contains(out.String(), "2 series skipped for labels without a labelFields entry") {
+		t.Errorf("report %q does not count the skipped series", out.String())
+	}
+
+	cursor, err := mem.Find(context.Background(), translate.Read{Database: "db", Collection: flat.Collection})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := 0
+	for cursor.Next(context.Background()) {
+		docs++
+	}
+	if docs != 2 {
+		t.Errorf("got %d documents, want 2", docs)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// IndexesConfig controls the index check run at startup.
+type IndexesConfig struct {
+	CheckOnStartup bool `yaml:"checkOnStartup"` // log collections missing a recommended index
+	AutoCreate     bool `yaml:"autoCreate"`     // create missing recommended indexes
+}
+
+// indexAdvice is the recommended index for one collection and whether an
+// existing index already serves it.
+type indexAdvice struct {
+	key        string // collection key in the configuration
+	collection string
+	fields     []string
+	existing   [][]string
+	covered    bool
+}
+
+// recommendedIndex returns the compound index serving the bridge's queries on
+// a collection: equality fields first (tenant field, metric field, then the
+// label fields in label order, or IndexLabels when set) and the time field
+// last, so a range scan on time follows the equality prefix.
+func recommendedIndex(collInfo CollectionInfo) []string {
+	var fields []string
+	if conf.Tenancy.Enabled && conf.Tenancy.Mode == "field" {
+		fields = append(fields, conf.Tenancy.TenantField)
+	}
+	if collInfo.MetricField != "" {
+		fields = append(fields, collInfo.MetricField)
+	}
+	labelNames := collInfo.IndexLabels
+	if labelNames == nil {
+		for name := range collInfo.LabelFields {
+			labelNames = append(labelNames, name)
+		}
+		sort.Strings(labelNames)
+	}
+	for _, name := range labelNames {
+		field, ok := collInfo.LabelFields[name]
+		if !ok && collInfo.LabelsField != "" {
+			field, ok = collInfo.LabelsField+"."+name, true
+		}
+		if ok && !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	if collInfo.TimeField != "" && !slices.Contains(fields, collInfo.TimeField) {
+		fields = append(fields, collInfo.TimeField)
+	}
+	return fields
+}
+
+// adviseIndexes compares the recommended index of every configured
+// collection, and of its rollups, with the indexes that exist.
+func adviseIndexes(ctx context.Context, db *mongo.Database) ([]indexAdvice, error) {
+	keys := make([]string, 0, len(conf.Collections))
+	for key := range conf.Collections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var advice []indexAdvice
+	seen := map[string]bool{}
+	for _, key := range keys {
+		collInfo := conf.Collections[key]
+		names := []string{collInfo.Name}
+		for _, r := range collInfo.Rollups {
+			names = append(names, r.Name)
+		}
+		fields := recommendedIndex(collInfo)
+		for _, name := range names {
+			if seen[name] || len(fields) == 0 {
+				continue
+			}
+			seen[name] = true
+			existing, err := listIndexKeys(ctx, db.Collection(name))
+			if err != nil {
+				return nil, fmt.Errorf("listing indexes of %s: %w", name, err)
+			}
+			a := indexAdvice{key: key, collection: name, fields: fields, existing: existing}
+			for _, idx := range existing {
+				if hasPrefix(idx, fields) {
+					a.covered = true
+					break
+				}
+			}
+			advice = append(advice, a)
+		}
+	}
+	return advice, nil
+}
+
+// listIndexKeys returns the key fields of each index of a collection.
+func listIndexKeys(ctx context.Context, coll *mongo.Collection) ([][]string, error) {
+	cursor, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var out [][]string
+	for cursor.Next(ctx) {
+		var spec struct {
+			Key bson.D `bson:"key"`
+		}
+		if err := cursor.Decode(&spec); err != nil {
+			return nil, err
+		}
+		fields := make([]string, 0, len(spec.Key))
+		for _, e := range spec.Key {
+			fields = append(fields, e.Key)
+		}
+		out = append(out, fields)
+	}
+	return out, cursor.Err()
+}
+
+// hasPrefix reports whether an index starts with the given fields in order.
+func hasPrefix(index, fields []string) bool {
+	if len(index) < len(fields) {
+		return false
+	}
+	for i, f := range fields {
+		if index[i] != f {
+			return false
+		}
+	}
+	return true
+}
+
+// createIndex creates the recommended index of a collection.
+func createIndex(ctx context.Context, db *mongo.Database, a indexAdvice) (string, error) {
+	keys := bson.D{}
+	for _, f := range a.fields {
+		keys = append(keys, bson.E{Key: f, Value: 1})
+	}
+	return db.Collection(a.collection).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys})
+}
+
+// checkIndexes runs the startup index check, creating missing indexes when
+// configured to.
+func checkIndexes(ctx context.Context, cfg IndexesConfig) {
+	if !cfg.CheckOnStartup && !cfg.AutoCreate {
+		return
+	}
+	if !mongoHealthy.Load() {
+		slog.Warn("Skipping index check, MongoDB is unreachable")
+		return
+	}
+	defer useMongo()()
+	db := mongoClient().Database(conf.MongoDB.Database)
+	advice, err := adviseIndexes(ctx, db)
+	if err != nil {
+		slog.Warn("Index check failed", "err", err)
+		return
+	}
+	for _, a := range advice {
+		if a.covered {
+			continue
+		}
+		if !cfg.AutoCreate {
+			slog.Warn("Collection is missing a recommended index", "collection", a.collection, "index", indexString(a.fields))
+			continue
+		}
+		name, err := createIndex(ctx, db, a)
+		if err != nil {
+			slog.Error("Error creating index", "collection", a.collection, "index", indexString(a.fields), "err", err)
+			continue
+		}
+		slog.Info("Created index", "collection", a.collection, "name", name)
+	}
+}
+
+func indexString(fields []string) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = f + ": 1"
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// runIndexesCommand implements the "indexes" subcommand: it reports the
+// recommended index of each collection and, with -create, creates the
+// missing ones. It exits with 1 when indexes are missing and not created.
+func runIndexesCommand(args []string) int {
+	fs, configFile := commandFlags("indexes")
+	create := fs.Bool("create", false, "Create missing indexes")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := loadConfig(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	client, err := commandConnect(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "connecting to MongoDB:", err)
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(conf.MongoDB.Database)
+	advice, err := adviseIndexes(ctx, db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	missing := 0
+	for _, a := range advice {
+		printAdvice(os.Stdout, a)
+		if a.covered {
+			continue
+		}
+		if !*create {
+			missing++
+			continue
+		}
+		name, err := createIndex(ctx, db, a)
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "  create failed: %v\n", err)
+			missing++
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "  created %s\n", name)
+	}
+	if missing > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printAdvice(w io.Writer, a indexAdvice) {
+	status := "missing"
+	if a.covered {
+		status = "ok"
+	}
+	fmt.Fprintf(w, "%s (%s): %s\n  recommended %s\n", a.collection, a.key, status, indexString(a.fields))
+	for _, idx := range a.existing {
+		fmt.Fprintf(w, "  existing    %s\n", indexString(idx))
+	}
+}
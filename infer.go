@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Field names preferred when several fields qualify for a role.
+var (
+	timeFieldNames   = []string{"timestamp", "time", "ts", "date", "@timestamp", "created_at"}
+	valueFieldNames  = []string{"value", "val", "v", "metric_value", "count"}
+	metricFieldNames = []string{"metric_name", "metric", "name", "__name__", "measurement"}
+	labelsFieldNames = []string{"labels", "tags", "metadata", "meta", "dimensions"}
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// fieldProfile summarises one top-level field across the sampled documents.
+type fieldProfile struct {
+	name    string
+	present int
+	types   map[string]int
+	values  map[string]bool // distinct string values, capped
+}
+
+// inferredCollection is a CollectionInfo block as printed by infer.
+type inferredCollection struct {
+	Name        string            `yaml:"name"`
+	TimeField   string            `yaml:"timeField"`
+	MetricField string            `yaml:"metricField,omitempty"`
+	ValueField  string            `yaml:"valueField"`
+	LabelFields map[string]string `yaml:"labelFields,omitempty"`
+	DefaultLbls map[string]string `yaml:"defaultLabels,omitempty"`
+	LabelsField string            `yaml:"labelsField,omitempty"`
+}
+
+// runInferCommand implements the "infer" subcommand: it samples a collection
+// and prints a proposed collections entry and mappings for it.
+func runInferCommand(args []string) int {
+	fs, configFile := commandFlags("infer")
+	collection := fs.String("collection", "", "Collection to inspect (required)")
+	database := fs.String("database", "", "Database, defaults to mongodb.database from the config")
+	samples := fs.Int("samples", defaultSampleSize, "Documents to sample")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *collection == "" {
+		fmt.Fprintln(os.Stderr, "infer: -collection is required")
+		return 2
+	}
+	if err := loadConfig(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *database == "" {
+		*database = conf.MongoDB.Database
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	client, err := commandConnect(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "connecting to MongoDB:", err)
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+
+	docs, err := sampleDocuments(ctx, client.Database(*database).Collection(*collection), *samples)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sampling documents:", err)
+		return 1
+	}
+	if len(docs) == 0 {
+		fmt.Fprintf(os.Stderr, "infer: collection %s.%s is empty\n", *database, *collection)
+		return 1
+	}
+	info, metrics, notes := inferCollection(*collection, docs)
+	if info.TimeField == "" || info.ValueField == "" {
+		notes = append(notes, "no usable time or value field found; fill them in by hand")
+	}
+
+	key := invalidLabelChars.ReplaceAllString(*collection, "_")
+	mappings := map[string]string{}
+	for _, m := range metrics {
+		mappings[m] = key
+	}
+	out, err := yaml.Marshal(map[string]interface{}{
+		"collections": map[string]inferredCollection{key: info},
+		"mappings":    mappings,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("# Proposed configuration for %s.%s, inferred from %d sampled documents.\n", *database, *collection, len(docs))
+	for _, n := range notes {
+		fmt.Printf("# NOTE: %s\n", n)
+	}
+	os.Stdout.Write(out)
+	return 0
+}
+
+// inferCollection proposes a collection layout from sampled documents. It
+// returns the layout, the metric names seen and notes about ambiguities.
+func inferCollection(name string, docs []map[string]interface{}) (inferredCollection, []string, []string) {
+	profiles := profileFields(docs)
+	info := inferredCollection{Name: name}
+	var notes []string
+	used := map[string]bool{"_id": true}
+
+	pick := func(role string, preferred []string, ok func(*fieldProfile) bool) string {
+		var candidates []string
+		for _, p := range sortedProfiles(profiles) {
+			if !used[p.name] && ok(p) {
+				candidates = append(candidates, p.name)
+			}
+		}
+		if len(candidates) == 0 {
+			return ""
+		}
+		choice := candidates[0]
+		for _, pref := range preferred {
+			if slices.Contains(candidates, pref) {
+				choice = pref
+				break
+			}
+		}
+		if len(candidates) > 1 {
+			notes = append(notes, fmt.Sprintf("%s: chose %q among %s", role, choice, strings.Join(candidates, ", ")))
+		}
+		used[choice] = true
+		return choice
+	}
+
+	info.TimeField = pick("timeField", timeFieldNames, func(p *fieldProfile) bool {
+		return p.types["date"] > p.present/2
+	})
+	if info.TimeField == "" {
+		info.TimeField = pick("timeField", timeFieldNames, func(p *fieldProfile) bool {
+			return slices.Contains(timeFieldNames, p.name) && p.present > 0
+		})
+	}
+	info.ValueField = pick("valueField", valueFieldNames, func(p *fieldProfile) bool {
+		return p.types["double"]+p.types["int"]+p.types["long"]+p.types["decimal"] > p.present/2
+	})
+	info.MetricField = pick("metricField", metricFieldNames, func(p *fieldProfile) bool {
+		return slices.Contains(metricFieldNames, p.name) && p.types["string"] == p.present
+	})
+	info.LabelsField = pick("labelsField", labelsFieldNames, func(p *fieldProfile) bool {
+		return p.types["object"] == p.present
+	})
+
+	var metrics []string
+	if info.MetricField != "" {
+		for v := range profiles[info.MetricField].values {
+			metrics = append(metrics, v)
+		}
+		sort.Strings(metrics)
+	} else {
+		metric := invalidLabelChars.ReplaceAllString(name, "_")
+		info.DefaultLbls = map[string]string{model.MetricNameLabel: metric}
+		metrics = []string{metric}
+		notes = append(notes, fmt.Sprintf("no metric name field; all documents are exposed as %q", metric))
+	}
+
+	// Remaining string fields with repeating values become labels; fields
+	// unique to almost every document (IDs, messages) are left out.
+	info.LabelFields = map[string]string{}
+	for _, p := range sortedProfiles(profiles) {
+		if used[p.name] || p.types["string"] != p.present {
+			continue
+		}
+		if len(p.values) > len(docs)/2 && len(docs) >= 10 {
+			notes = append(notes, fmt.Sprintf("%q skipped as a label: %d distinct values in %d documents", p.name, len(p.values), len(docs)))
+			continue
+		}
+		info.LabelFields[invalidLabelChars.ReplaceAllString(p.name, "_")] = p.name
+	}
+	return info, metrics, notes
+}
+
+const maxProfiledValues = 1000
+
+// profileFields records presence, types and distinct string values of the
+// top-level fields of docs.
+func profileFields(docs []map[string]interface{}) map[string]*fieldProfile {
+	profiles := map[string]*fieldProfile{}
+	for _, doc := range docs {
+		for k, v := range doc {
+			p, ok := profiles[k]
+			if !ok {
+				p = &fieldProfile{name: k, types: map[string]int{}, values: map[string]bool{}}
+				profiles[k] = p
+			}
+			p.present++
+			p.types[bsonTypeName(v)]++
+			if s, ok := v.(string); ok && len(p.values) < maxProfiledValues {
+				p.values[s] = true
+			}
+		}
+	}
+	return profiles
+}
+
+// sortedProfiles returns the profiles ordered by field name.
+func sortedProfiles(profiles map[string]*fieldProfile) []*fieldProfile {
+	out := make([]*fieldProfile, 0, len(profiles))
+	for _, k := range sortedKeys(profiles) {
+		out = append(out, profiles[k])
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInferCollection(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var docs []map[string]interface{}
+	for i := 0; i < 10; i++ {
+		docs = append(docs, map[string]interface{}{
+			"_id":         fmt.Sprint(i),
+			"timestamp":   t0.Add(time.Duration(i) * time.Minute),
+			"created_at":  t0,
+			"value":       float64(i),
+			"metric_name": []string{"cpu", "mem"}[i%2],
+			"host-name":   []string{"a", "b"}[i%2],
+			"message":     fmt.Sprint("request ", i),
+			"tags":        map[string]interface{}{"zone": "z"},
+		})
+	}
+
+	info, metrics, notes := inferCollection("host_stats", docs)
+	want := inferredCollection{
+		Name:        "host_stats",
+		TimeField:   "timestamp",
+		MetricField: "metric_name",
+		ValueField:  "value",
+		LabelFields: map[string]string{"host_name": "host-name"},
+		LabelsField: "tags",
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+	if !reflect.DeepEqual(metrics, []string{"cpu", "mem"}) {
+		t.Errorf("got metrics %v", metrics)
+	}
+	wantNotes := []string{
+		`timeField: chose "timestamp" among created_at, timestamp`,
+		`"message" skipped as a label: 10 distinct values in 10 documents`,
+	}
+	if !reflect.DeepEqual(notes, wantNotes) {
+		t.Errorf("got notes %q, want %q", notes, wantNotes)
+	}
+
+	// Without a metric name field the collection becomes a single metric.
+	for _, doc := range docs {
+		delete(doc, "metric_name")
+	}
+	info, metrics, _ = inferCollection("host-stats", docs)
+	if info.MetricField != "" || info.DefaultLbls["__name__"] != "host_stats" || !reflect.DeepEqual(metrics, []string{"host_stats"}) {
+		t.Errorf("got %+v, metrics %v", info, metrics)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogConfig controls the application logger and the optional query log.
+type LogConfig struct {
+	Level             string `yaml:"level"`             // debug, info, warn or error
+	Format            string `yaml:"format"`            // logfmt (text) or json
+	QueryLogFile      string `yaml:"queryLogFile"`      // JSON-per-query log, disabled when empty
+	QueryLogMaxSizeMB int    `yaml:"queryLogMaxSizeMB"` // rotate the query log after this many megabytes
+	QueryLogMaxFiles  int    `yaml:"queryLogMaxFiles"`  // number of rotated query log files to keep
+}
+
+const requestIDHeader = "X-Request-Id"
+
+type ctxKey int
+
+const (
+	ctxKeyLogger ctxKey = iota
+	ctxKeyRequestID
+	ctxKeyQueryStats
+	ctxKeyPrincipal
+	ctxKeyScope
+)
+
+// queryLogger writes one JSON line per query, in the same shape as the
+// Prometheus query log. It is nil when the query log is disabled.
+var queryLogger *slog.Logger
+
+// setupLogging configures the default slog logger and, if configured, the query log.
+func setupLogging(cfg LogConfig) (io.Closer, error) {
+	var level slog.Level
+	switch strings.ToLower(cfg.Level) {
+	case "", "info":
+		level = slog.LevelInfo
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q", cfg.Level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "logfmt", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if cfg.QueryLogFile == "" {
+		return nil, nil
+	}
+	f, err := newRotatingFile(cfg.QueryLogFile, int64(cfg.QueryLogMaxSizeMB)*1024*1024, cfg.QueryLogMaxFiles)
+	if err != nil {
+		return nil, fmt.Errorf("opening query log: %w", err)
+	}
+	queryLogger = slog.New(slog.NewJSONHandler(f, nil))
+	return f, nil
+}
+
+// loggerFromContext returns the request-scoped logger, falling back to the default logger.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKeyLogger).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// requestIDFromContext returns the request ID assigned by withRequestID, if any.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyRequestID).(string)
+	return id
+}
+
+// withRequestID assigns each request an ID (reusing the client's X-Request-Id when
+// present), echoes it back in the response and attaches a tagged logger to the context.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := slog.Default().With("request_id", id)
+		ctx := context.WithValue(r.Context(), ctxKeyRequestID, id)
+		ctx = context.WithValue(ctx, ctxKeyLogger, logger)
+		logger.Debug("Request received", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// queryStats collects execution details of a single query for the query log.
+type queryStats struct {
+	mu          sync.Mutex
+	collections []string
+	docsScanned int
+	cacheHits   int
+	cacheMisses int
+}
+
+func (s *queryStats) addCollection(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.collections {
+		if c == name {
+			return
+		}
+	}
+	s.collections = append(s.collections, name)
+}
+
+func (s *queryStats) addDocs(n int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.docsScanned += n
+	s.mu.Unlock()
+}
+
+// addCacheResult records whether an interval was answered from the results cache.
+func (s *queryStats) addCacheResult(hit bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if hit {
+		s.cacheHits++
+	} else {
+		s.cacheMisses++
+	}
+	s.mu.Unlock()
+}
+
+func withQueryStats(ctx context.Context, s *queryStats) context.Context {
+	return context.WithValue(ctx, ctxKeyQueryStats, s)
+}
+
+// queryStatsFromContext returns the stats collector of the current query, or nil.
+func queryStatsFromContext(ctx context.Context) *queryStats {
+	s, _ := ctx.Value(ctxKeyQueryStats).(*queryStats)
+	return s
+}
+
+// logQuery writes a query log entry if the query log is enabled.
+func logQuery(r *http.Request, params map[string]interface{}, stats *queryStats, took time.Duration, err error) {
+	if queryLogger == nil {
+		return
+	}
+	clientIP, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		clientIP = r.RemoteAddr
+	}
+	stats.mu.Lock()
+	collections := append([]string(nil), stats.collections...)
+	docs := stats.docsScanned
+	hits, misses := stats.cacheHits, stats.cacheMisses
+	stats.mu.Unlock()
+
+	attrs := []slog.Attr{
+		slog.String("requestId", requestIDFromContext(r.Context())),
+		slog.Any("httpRequest", map[string]string{
+			"clientIP": clientIP,
+			"method":   r.Method,
+			"path":     r.URL.Path,
+		}),
+		slog.Any("params", params),
+		slog.Any("stats", map[string]interface{}{
+			"timings": map[string]float64{
+				"execTotalTime": took.Seconds(),
+			},
+			"collections":      collections,
+			"documentsScanned": docs,
+			"cacheHits":        hits,
+			"cacheMisses":      misses,
+		}),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	queryLogger.LogAttrs(context.Background(), slog.LevelInfo, "promql query logged", attrs...)
+}
+
+// rotatingFile is an io.WriteCloser that rotates the underlying file once it
+// grows past maxSize, keeping at most maxFiles old copies (path.1 ... path.N).
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize && rf.size > 0 {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if rf.maxFiles > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxFiles))
+		for i := rf.maxFiles - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
@@ -9,13 +9,17 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/radek-ryckowski/promql2monogo/translate"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/yaml.v3"
@@ -23,50 +27,160 @@ import (
 
 type Config struct {
 	Server struct {
-		Host      string `yaml:"host"`
-		Port      int    `yaml:"port"`
-		QueryPath string `yaml:"queryPath"`
+		Host         string `yaml:"host"`
+		Port         int    `yaml:"port"`
+		QueryPath    string `yaml:"queryPath"`
+		ReadyTimeout int    `yaml:"readyTimeout"` // seconds allowed for the /-/ready MongoDB checks
+		// HTTP server timeouts in seconds
+		ReadTimeout     int `yaml:"readTimeout"`
+		WriteTimeout    int `yaml:"writeTimeout"`
+		IdleTimeout     int `yaml:"idleTimeout"`
+		ShutdownTimeout int `yaml:"shutdownTimeout"` // how long to wait for in-flight requests on SIGTERM
+		ShutdownDelay   int `yaml:"shutdownDelay"`   // how long to report not ready before closing the listener
+
+		TLS            TLSConfig         `yaml:"tls"`
+		BasicAuthUsers map[string]string `yaml:"basicAuthUsers"` // user -> bcrypt hash
+		BearerTokens   map[string]string `yaml:"bearerTokens"`   // name -> token
 	} `yaml:"server"`
 	MongoDB struct {
-		URI      string `yaml:"uri"`
-		Database string `yaml:"database"`
-		Timeout  int    `yaml:"timeout"`
+		URI                 string `yaml:"uri"`
+		Database            string `yaml:"database"`
+		Timeout             int    `yaml:"timeout"`
+		HealthCheckInterval int    `yaml:"healthCheckInterval"` // seconds between connection pings
+		MaxReconnectBackoff int    `yaml:"maxReconnectBackoff"` // upper bound in seconds for reconnect backoff
 	} `yaml:"mongodb"`
-	Collections map[string]CollectionInfo `yaml:"collections"`
-	Mappings    map[string]string         `yaml:"mappings"`
+	Log            LogConfig                 `yaml:"log"`
+	Tenancy        TenancyConfig             `yaml:"tenancy"`
+	AccessPolicies map[string]AccessPolicy   `yaml:"accessPolicies"` // principal -> matchers enforced on all of its queries
+	Rules          RulesConfig               `yaml:"rules"`
+	Cache          CacheConfig               `yaml:"cache"`
+	Rollups        RollupsConfig             `yaml:"rollups"`
+	Indexes        IndexesConfig             `yaml:"indexes"`
+	OTLP           OTLPConfig                `yaml:"otlp"`
+	Collections    map[string]CollectionInfo `yaml:"collections"`
+	Mappings       map[string]Mapping        `yaml:"mappings"`
+	RelabelConfigs []*relabel.Config         `yaml:"relabelConfigs"` // applied to every series after the collection's own
 }
 
-var (
-	conf   Config
-	client *mongo.Client
-)
+var conf Config
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
 	configFile := flag.String("config", "config.yaml", "Path to config file")
+	flag.Usage = usage
 	flag.Parse()
 
-	f, err := os.Open(*configFile)
-	if err != nil {
+	if err := loadConfig(*configFile); err != nil {
 		log.Fatal(err)
 	}
-	defer f.Close()
-	if err := yaml.NewDecoder(f).Decode(&conf); err != nil {
+
+	queryLog, err := setupLogging(conf.Log)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if queryLog != nil {
+		defer queryLog.Close()
+	}
+
+	if err := validateTenancy(conf.Tenancy); err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	if err := validateRollups(conf.Collections); err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	if err := validateTransforms(conf); err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	if err := loadAccessPolicies(conf.AccessPolicies); err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	tlsCfg, err := buildTLSConfig(conf.Server.TLS)
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "err", err)
+		os.Exit(1)
+	}
+	auth, err := newAuthenticator(conf.Server.BasicAuthUsers, conf.Server.BearerTokens)
+	if err != nil {
+		slog.Error("Invalid authentication configuration", "err", err)
+		os.Exit(1)
+	}
 
-	// Connect to MongoDB
+	// Connect to MongoDB. An unreachable server does not prevent startup; the
+	// bridge reports not ready until the connection monitor reaches it.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.MongoDB.Timeout)*time.Second)
 	defer cancel()
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI(conf.MongoDB.URI))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(conf.MongoDB.URI))
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Failed to connect to MongoDB", "err", err)
+		os.Exit(1)
+	}
+	setMongoClient(client)
+	if err := client.Ping(ctx, nil); err != nil {
+		slog.Warn("MongoDB is not reachable yet", "err", err)
+	} else {
+		mongoHealthy.Store(true)
+	}
+
+	// Everything below runs until SIGINT or SIGTERM.
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go monitorMongo(runCtx)
+	setupCache(runCtx, conf.Cache)
+	go runRollups(runCtx)
+	go checkIndexes(runCtx, conf.Indexes)
+
+	if err := startRuleManager(runCtx); err != nil {
+		slog.Error("Failed to start rule manager", "err", err)
+		os.Exit(1)
 	}
 
 	// Set up server
-	http.HandleFunc(conf.Server.QueryPath, handleQuery)
-	addr := fmt.Sprintf("%s:%d", conf.Server.Host, conf.Server.Port)
-	log.Printf("Server listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	mux := http.NewServeMux()
+	mux.HandleFunc(conf.Server.QueryPath, handleQuery)
+	mux.HandleFunc("/api/v1/rules", handleRules)
+	mux.HandleFunc("/api/v1/alerts", handleAlerts)
+	mux.HandleFunc("/api/v1/tail", handleTail)
+	mux.HandleFunc("/api/v1/explain", handleExplain)
+	mux.HandleFunc("/api/v1/metadata", handleMetadata)
+	mux.HandleFunc("/api/v1/export", handleExport)
+	mux.HandleFunc("/federate", handleFederate)
+	if conf.OTLP.Enabled {
+		mux.Handle("/v1/metrics", newOTLPHandler(conf.OTLP))
+	}
+	registerStatusHandlers(mux)
+	serveErr := runServer(runCtx, withRequestID(withAuth(auth, withMongo(mux))), tlsCfg)
+
+	// Stop background work before the MongoDB client goes away.
+	stopRuleManager()
+	disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), time.Duration(conf.MongoDB.Timeout)*time.Second)
+	defer cancelDisconnect()
+	if err := mongoClient().Disconnect(disconnectCtx); err != nil {
+		slog.Warn("Error disconnecting from MongoDB", "err", err)
+	}
+	if serveErr != nil {
+		slog.Error("Server stopped", "err", serveErr)
+		os.Exit(1)
+	}
+	slog.Info("Shutdown complete")
+}
+
+// loadConfig reads the YAML configuration file into conf.
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return yaml.NewDecoder(f).Decode(&conf)
 }
 
 // parseTime parses a Prometheus timestamp string (Unix seconds or RFC3339)
@@ -105,6 +219,7 @@ func parseDuration(s string) (time.Duration, error) {
 }
 
 func handleQuery(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
 	// Get query parameter from URL query parameters
 	queryValues := r.URL.Query()
 	queryParam := queryValues.Get("query")
@@ -141,9 +256,9 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
 			sendJSONError(w, http.StatusBadRequest, "bad_data", "end time must not be before start time")
 			return
 		}
-		log.Printf("Debug: Range query detected: start=%v, end=%v, step=%v", startTime, endTime, step)
+		logger.Debug("Range query detected", "start", startTime, "end", endTime, "step", step)
 	} else {
-		log.Printf("Debug: Instant query detected")
+		logger.Debug("Instant query detected")
 	}
 
 	// If query is empty and it's a POST request, try to read from body
@@ -152,19 +267,18 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err == nil {
 			queryParam = r.PostFormValue("query")
-			log.Printf("Debug: found query in form: %s", queryParam)
+			logger.Debug("Found query in form", "query", queryParam)
 		}
 
 		// If still empty, try JSON body
 		if queryParam == "" && r.Body != nil {
 			bodyBytes, err := io.ReadAll(r.Body)
 			if err == nil && len(bodyBytes) > 0 {
-				log.Printf("Debug: received POST body: %s", string(bodyBytes))
+				logger.Debug("Received POST body", "bytes", len(bodyBytes))
 
 				// Try to parse as JSON
 				var jsonData map[string]interface{}
 				if json.Unmarshal(bodyBytes, &jsonData) == nil {
-					log.Printf("Debug: found JSON data: %v", jsonData)
 					if query, ok := jsonData["query"].(string); ok && query != "" {
 						queryParam = query
 					}
@@ -181,41 +295,111 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	metric, labels, err := parsePromQL(queryParam)
+	scope, err := resolveScope(r)
+	if err != nil {
+		logger.Info("Rejected query", "err", err)
+		sendScopeError(w, err)
+		return
+	}
+	if isRangeQuery {
+		if err := scope.checkRange(startTime, endTime); err != nil {
+			sendJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+	}
+
+	stats := &queryStats{}
+	params := map[string]interface{}{"query": queryParam}
+	if scope.Tenant != "" {
+		params["tenant"] = scope.Tenant
+	}
+	if isRangeQuery {
+		params["start"] = startTime.UTC().Format(time.RFC3339Nano)
+		params["end"] = endTime.UTC().Format(time.RFC3339Nano)
+		params["step"] = step.Seconds()
+	}
+	began := time.Now()
+	var queryErr error
+	defer func() {
+		logQuery(r, params, stats, time.Since(began), queryErr)
+	}()
+
+	// The time range is half-open and BSON dates have millisecond precision,
+	// so one millisecond past endTime includes it.
+	var planEnd time.Time
+	if isRangeQuery {
+		planEnd = endTime.Add(time.Millisecond)
+	}
+	plan, err := scope.translator().Translate(queryParam, startTime, planEnd)
 	if err != nil {
+		queryErr = err
 		sendJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
 		return
 	}
-	collKey, ok := conf.Mappings[metric]
-	if !ok {
-		sendJSONError(w, http.StatusBadRequest, "bad_data", "unknown metric")
+	if len(plan.Reads) > 1 {
+		queryErr = errors.New("metrics in several collections")
+		sendJSONError(w, http.StatusBadRequest, "bad_data", "the selector matches metrics in several collections")
 		return
 	}
+	read := plan.Reads[0]
+	collInfo := scope.Collections[read.Key]
+	ctx, cancel := context.WithTimeout(withScope(withQueryStats(r.Context(), stats), scope), 15*time.Second)
+	defer cancel()
 
-	collInfo := conf.Collections[collKey]
-	// Pass time range to buildMongoFilter if it's a range query
-	filter := buildMongoFilter(labels, collInfo.LabelFields, collInfo.TimeField, startTime, endTime)
+	if explainRequested(r) {
+		explainQuery(ctx, w, queryParam, scope, queryPlan(scope, read, collInfo, isRangeQuery, step))
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-	cursor, err := client.Database(conf.MongoDB.Database).Collection(collInfo.Name).Find(ctx, filter)
+	if isRangeQuery && (resultsCache != nil || len(collInfo.Rollups) > 0) {
+		results, err := rangeQuery(ctx, scope, queryParam, read, collInfo, startTime, endTime, step)
+		if errors.Is(err, errLimitExceeded) {
+			queryErr = err
+			sendJSONError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+			return
+		}
+		if err != nil {
+			queryErr = err
+			sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		sendResults(w, logger, results)
+		return
+	}
+
+	logger.Debug("Translated query", "database", scope.Database, "collection", collInfo.Name, "filter", translate.Filter(read))
+
+	stats.addCollection(collInfo.Name)
+	cursor, err := dataBackend().Find(ctx, read)
 	if err != nil {
+		queryErr = err
 		sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
 		return
 	}
 	defer cursor.Close(ctx)
 
 	// Pass isRangeQuery flag to mongoCursorToProm
-	results, err := mongoCursorToProm(cursor, collInfo, isRangeQuery)
+	results, err := mongoCursorToProm(ctx, cursor, collInfo, isRangeQuery)
+	if errors.Is(err, errLimitExceeded) {
+		queryErr = err
+		sendJSONError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+		return
+	}
 	if err != nil {
+		queryErr = err
 		sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
 		return
 	}
 
+	sendResults(w, logger, results)
+}
+
+// sendResults writes a complete query response as built by mongoCursorToProm.
+func sendResults(w http.ResponseWriter, logger *slog.Logger, results map[string]interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(results); err != nil {
 		// Log error, but response might be already partially written
-		log.Printf("Error encoding JSON response: %v", err)
+		logger.Error("Error encoding JSON response", "err", err)
 		// Avoid calling sendJSONError here as headers might be sent
 	}
 }
@@ -232,67 +416,47 @@ func sendJSONError(w http.ResponseWriter, status int, errorType, message string)
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
-func parsePromQL(query string) (string, map[string]string, error) {
-	log.Default().Printf("Debug: parsing query: %s", query)
-	expr, err := parser.ParseExpr(query)
-	if err != nil {
-		return "", nil, err
+// sendJSON writes a successful Prometheus API response wrapping data.
+func sendJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{
+		"status": "success",
+		"data":   data,
 	}
-
-	labelMap := map[string]string{}
-	var metricName string
-
-	// Identify if expression is a VectorSelector or MatrixSelector
-	var vs *parser.VectorSelector
-	switch e := expr.(type) {
-	case *parser.VectorSelector:
-		vs = e
-	case *parser.MatrixSelector:
-		vs = e.VectorSelector.(*parser.VectorSelector)
-	default:
-		return "", nil, fmt.Errorf("unsupported expression type: %T", expr)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Error encoding JSON response", "err", err)
 	}
+}
 
-	// Pull out __name__ (the metric name) and any other labels
-	for _, matcher := range vs.LabelMatchers {
-		if matcher.Name == model.MetricNameLabel { // "__name__"
-			metricName = matcher.Value
-		} else {
-			labelMap[matcher.Name] = matcher.Value
-		}
-	}
-	return metricName, labelMap, nil
+// CollectionInfo is a collection layout together with the bridge's settings for it.
+type CollectionInfo struct {
+	translate.Collection `yaml:",inline"`
+	Rollups              []RollupInfo `yaml:"rollups"`     // Downsampled copies, used for queries with a coarse enough step
+	IndexLabels          []string     `yaml:"indexLabels"` // Labels in the recommended index, defaults to all labelFields
 }
 
-// Add timeField, startTime, endTime parameters
-func buildMongoFilter(labels map[string]string, fields map[string]string, timeField string, startTime, endTime time.Time) map[string]interface{} {
-	filter := make(map[string]interface{})
-	for k, v := range labels {
-		if mappedField, ok := fields[k]; ok {
-			filter[mappedField] = v
-		}
+// validateTransforms checks the value transforms and derived labels of the
+// global and tenant collections at startup.
+func validateTransforms(cfg Config) error {
+	all := map[string]map[string]CollectionInfo{"collections": cfg.Collections}
+	for id, t := range cfg.Tenancy.Tenants {
+		all["tenants."+id+".collections"] = t.Collections
 	}
-	// Add time range filter if start and end times are provided (non-zero)
-	if !startTime.IsZero() && !endTime.IsZero() && timeField != "" {
-		filter[timeField] = map[string]interface{}{
-			"$gte": startTime,
-			"$lte": endTime,
+	for path, collections := range all {
+		for key, c := range collections {
+			if err := c.Validate(); err != nil {
+				return fmt.Errorf("%s.%s: %w", path, key, err)
+			}
 		}
 	}
-	return filter
+	return nil
 }
 
-// Define a named type for collection info to avoid type mismatch
-type CollectionInfo struct {
-	Name        string            `yaml:"name"`
-	TimeField   string            `yaml:"timeField"`
-	MetricField string            `yaml:"metricField"` // Field for __name__ label
-	ValueField  string            `yaml:"valueField"`  // Field for the numeric value
-	LabelFields map[string]string `yaml:"labelFields"`
-	DefaultLbls map[string]string `yaml:"defaultLabels"`
-}
-
-func mongoCursorToProm(cursor *mongo.Cursor, colInfo CollectionInfo, isRangeQuery bool) (map[string]interface{}, error) {
+func mongoCursorToProm(ctx context.Context, cursor translate.Cursor, colInfo CollectionInfo, isRangeQuery bool) (map[string]interface{}, error) {
+	logger := loggerFromContext(ctx)
+	stats := queryStatsFromContext(ctx)
+	limits := scopeFromContext(ctx).Limits
+	scanned := 0
 	resp := map[string]interface{}{
 		"status": "success",
 		"data":   map[string]interface{}{},
@@ -304,17 +468,23 @@ func mongoCursorToProm(cursor *mongo.Cursor, colInfo CollectionInfo, isRangeQuer
 		// Group results by metric signature (labels)
 		seriesMap := make(map[string]map[string]interface{}) // Map: label_signature -> series_data
 
-		ctx := context.TODO()
 		for cursor.Next(ctx) {
 			var doc map[string]interface{}
+			stats.addDocs(1)
+			scanned++
+			if limits.MaxDocuments > 0 && scanned > limits.MaxDocuments {
+				return nil, fmt.Errorf("%w: more than %d documents scanned", errLimitExceeded, limits.MaxDocuments)
+			}
 			if err := cursor.Decode(&doc); err != nil {
-				log.Printf("Error decoding document: %v", err)
+				logger.Warn("Error decoding document", "err", err)
 				continue // Skip problematic document
 			}
 
-			timestamp, valueStr, metricLabels, err := extractDataFromDoc(doc, colInfo)
+			timestamp, valueStr, metricLabels, err := colInfo.Extract(doc)
 			if err != nil {
-				log.Printf("Error extracting data from doc: %v", err)
+				if !errors.Is(err, translate.ErrDropped) {
+					logger.Warn("Error extracting data from doc", "err", err)
+				}
 				continue
 			}
 
@@ -324,6 +494,9 @@ func mongoCursorToProm(cursor *mongo.Cursor, colInfo CollectionInfo, isRangeQuer
 			// Find or create the series entry
 			series, exists := seriesMap[labelSignature]
 			if !exists {
+				if limits.MaxSeries > 0 && len(seriesMap) >= limits.MaxSeries {
+					return nil, fmt.Errorf("%w: more than %d series", errLimitExceeded, limits.MaxSeries)
+				}
 				series = map[string]interface{}{
 					"metric": metricLabels,
 					"values": make([]interface{}, 0), // Initialize as empty slice
@@ -351,42 +524,10 @@ func mongoCursorToProm(cursor *mongo.Cursor, colInfo CollectionInfo, isRangeQuer
 		resp["data"].(map[string]interface{})["resultType"] = "vector"
 		vectorResult := make([]interface{}, 0) // Always use an empty slice
 
-		ctx := context.TODO()
-		// For instant queries, we typically want the *latest* point for each series.
-		// Process all points and then filter to get the latest point for each unique set of labels.
-		// this is naively done by using a map to track the latest point for each label set.
-		// This approach need to be optimized as it is .. not great for performance.
-		// for example different values for the same lableset and timestamp are not handled (only the latest one is kept)
 		latestPoints := make(map[string]map[string]interface{}) // Map: label_signature -> latest_sample
-		for cursor.Next(ctx) {
-			var doc map[string]interface{}
-			if err := cursor.Decode(&doc); err != nil {
-				log.Printf("Error decoding document: %v", err)
-				continue
-			}
-
-			timestamp, valueStr, metricLabels, err := extractDataFromDoc(doc, colInfo)
-			if err != nil {
-				log.Printf("Error extracting data from doc: %v", err)
-				continue
-			}
-
-			// Create a unique signature for the series based on labels
-			labelSignature := createLabelSignature(metricLabels)
-
-			// Check if we already have a point for this label set
-			existing, exists := latestPoints[labelSignature]
-			if !exists || timestamp > existing["value"].([]interface{})[0].(float64) {
-				// Store this as the latest point for this label set
-				latestPoints[labelSignature] = map[string]interface{}{
-					"metric": metricLabels,
-					"value":  []interface{}{timestamp, valueStr},
-				}
-			}
-		}
-
-		if err := cursor.Err(); err != nil {
-			return nil, fmt.Errorf("cursor error: %w", err)
+		scanned := 0
+		if err := latestSamples(ctx, cursor, colInfo, latestPoints, &scanned); err != nil {
+			return nil, err
 		}
 
 		// Convert map to slice for final result
@@ -400,92 +541,61 @@ func mongoCursorToProm(cursor *mongo.Cursor, colInfo CollectionInfo, isRangeQuer
 	return resp, nil
 }
 
-// Helper function to extract data and labels from a MongoDB document
-func extractDataFromDoc(doc map[string]interface{}, colInfo CollectionInfo) (float64, string, map[string]string, error) {
-	// Extract timestamp
-	var timestamp float64
-	if timeVal, ok := doc[colInfo.TimeField]; ok {
-		switch tv := timeVal.(type) {
-		case time.Time:
-			// Convert to Unix timestamp with potential fractions of a second
-			timestamp = float64(tv.UnixNano()) / 1e9
-		case string:
-			if t, err := time.Parse(time.RFC3339Nano, tv); err == nil { // Try Nano first
-				timestamp = float64(t.UnixNano()) / 1e9
-			} else if t, err := time.Parse(time.RFC3339, tv); err == nil { // Fallback to RFC3339
-				timestamp = float64(t.UnixNano()) / 1e9
-			} else {
-				log.Printf("Warning: could not parse time string '%s', using current time", tv)
-				timestamp = float64(time.Now().UnixNano()) / 1e9
-			}
-		case float64:
-			timestamp = tv // Assume it's already Unix seconds
-		case int64:
-			timestamp = float64(tv) // Assume it's Unix seconds
-		case int32:
-			timestamp = float64(tv) // Assume it's Unix seconds
-		// Add handling for MongoDB specific date types if necessary (e.g., primitive.DateTime)
-		default:
-			log.Printf("Warning: unhandled time type '%T' for field '%s', using current time", tv, colInfo.TimeField)
-			timestamp = float64(time.Now().UnixNano()) / 1e9
+// latestSamples adds the latest point of each series in the cursor to
+// latestPoints, keyed by label signature, as the instant query result
+// {"metric": labels, "value": [timestamp, value]}. Documents are counted in
+// scanned, which may be shared across the reads of one request, against the
+// scope's document limit.
+func latestSamples(ctx context.Context, cursor translate.Cursor, colInfo CollectionInfo, latestPoints map[string]map[string]interface{}, scanned *int) error {
+	logger := loggerFromContext(ctx)
+	stats := queryStatsFromContext(ctx)
+	limits := scopeFromContext(ctx).Limits
+	// For instant queries, we typically want the *latest* point for each series.
+	// Process all points and then filter to get the latest point for each unique set of labels.
+	// this is naively done by using a map to track the latest point for each label set.
+	// This approach need to be optimized as it is .. not great for performance.
+	// for example different values for the same lableset and timestamp are not handled (only the latest one is kept)
+	for cursor.Next(ctx) {
+		var doc map[string]interface{}
+		stats.addDocs(1)
+		*scanned++
+		if limits.MaxDocuments > 0 && *scanned > limits.MaxDocuments {
+			return fmt.Errorf("%w: more than %d documents scanned", errLimitExceeded, limits.MaxDocuments)
 		}
-	} else {
-		log.Printf("Warning: time field '%s' not found, using current time", colInfo.TimeField)
-		timestamp = float64(time.Now().UnixNano()) / 1e9
-	}
-
-	// --- Extract numeric metric value from ValueField ---
-	metricValueStr := "0" // Default value
-	if val, ok := doc[colInfo.ValueField]; ok {
-		switch v := val.(type) {
-		case float64, float32, int, int64, int32:
-			metricValueStr = fmt.Sprintf("%v", v)
-		case string:
-			// Validate if it looks like a number before using it
-			if _, err := strconv.ParseFloat(v, 64); err == nil {
-				metricValueStr = v
-			} else {
-				log.Printf("Warning: non-numeric string value '%v' found in ValueField '%s', using default '0'", v, colInfo.ValueField)
-			}
-		default:
-			strVal := fmt.Sprintf("%v", v)
-			if _, err := strconv.ParseFloat(strVal, 64); err == nil {
-				metricValueStr = strVal
-			} else {
-				log.Printf("Warning: unparseable value type '%T' ('%v') in ValueField '%s', using default '0'", v, v, colInfo.ValueField)
+		if err := cursor.Decode(&doc); err != nil {
+			logger.Warn("Error decoding document", "err", err)
+			continue
+		}
+
+		timestamp, valueStr, metricLabels, err := colInfo.Extract(doc)
+		if err != nil {
+			if !errors.Is(err, translate.ErrDropped) {
+				logger.Warn("Error extracting data from doc", "err", err)
 			}
+			continue
 		}
-	} else {
-		log.Printf("Warning: value field '%s' not found, using default '0'", colInfo.ValueField)
-	}
-	// ----------------------------------------------------
 
-	// Build metric labels
-	metricLabels := make(map[string]string)
-	// Add default labels first
-	for k, v := range colInfo.DefaultLbls {
-		metricLabels[k] = v
-	}
-	// Add labels from the document, potentially overwriting defaults
-	for promLabel, mongoField := range colInfo.LabelFields {
-		if val, ok := doc[mongoField]; ok {
-			metricLabels[promLabel] = fmt.Sprintf("%v", val) // Convert label value to string
+		// Create a unique signature for the series based on labels
+		labelSignature := createLabelSignature(metricLabels)
+
+		// Check if we already have a point for this label set
+		existing, exists := latestPoints[labelSignature]
+		if !exists && limits.MaxSeries > 0 && len(latestPoints) >= limits.MaxSeries {
+			return fmt.Errorf("%w: more than %d series", errLimitExceeded, limits.MaxSeries)
+		}
+		if !exists || timestamp > existing["value"].([]interface{})[0].(float64) {
+			// Store this as the latest point for this label set
+			latestPoints[labelSignature] = map[string]interface{}{
+				"metric": metricLabels,
+				"value":  []interface{}{timestamp, valueStr},
+			}
 		}
 	}
 
-	// --- Add __name__ label based on the MetricField value ---
-	if nameVal, ok := doc[colInfo.MetricField]; ok {
-		metricLabels[model.MetricNameLabel] = fmt.Sprintf("%v", nameVal)
-	} else if _, ok := metricLabels[model.MetricNameLabel]; !ok {
-		// If __name__ wasn't set by defaults or labels, and MetricField was missing, log a warning.
-		log.Printf("Warning: MetricField '%s' not found and no default __name__ label set.", colInfo.MetricField)
-		// Optionally set a default __name__ here if desired, e.g.:
-		// metricLabels[model.MetricNameLabel] = "unknown"
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("cursor error: %w", err)
 	}
-	// ---------------------------------------------------------
-
-	// Return timestamp, the numeric metric value string, the labels map, and nil error
-	return timestamp, metricValueStr, metricLabels, nil
+	return nil
 }
 
 // Helper function to create a unique string signature from labels for grouping
@@ -495,7 +605,7 @@ func createLabelSignature(labels map[string]string) string {
 	bytes, err := json.Marshal(labels)
 	if err != nil {
 		// Fallback or handle error - shouldn't happen with map[string]string
-		log.Printf("Error creating label signature: %v", err)
+		slog.Error("Error creating label signature", "err", err)
 		return fmt.Sprintf("%v", labels) // Less reliable fallback
 	}
 	return string(bytes)
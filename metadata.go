@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// Mapping maps a metric name to a collection key and optionally describes
+// the metric. In the configuration it is either the collection key alone or
+// a mapping:
+//
+//	http_requests_total: http_requests
+//	http_request_duration_seconds:
+//	  collection: http_requests
+//	  type: histogram
+//	  help: Request latency.
+//	  unit: seconds
+type Mapping struct {
+	Collection string `yaml:"collection"`
+	Type       string `yaml:"type"` // counter, gauge, histogram or summary
+	Help       string `yaml:"help"`
+	Unit       string `yaml:"unit"`
+}
+
+// UnmarshalYAML accepts a plain collection key as well as a mapping.
+func (m *Mapping) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*m = Mapping{Collection: node.Value}
+		return nil
+	}
+	type plain Mapping
+	return node.Decode((*plain)(m))
+}
+
+// MarshalYAML writes mappings without metadata as the collection key alone.
+func (m Mapping) MarshalYAML() (interface{}, error) {
+	if !m.hasMetadata() {
+		return m.Collection, nil
+	}
+	type plain Mapping
+	return plain(m), nil
+}
+
+func (m Mapping) hasMetadata() bool {
+	return m.Type != "" || m.Help != "" || m.Unit != ""
+}
+
+// metricTypes are the metric types a mapping may declare.
+var metricTypes = map[string]bool{"counter": true, "gauge": true, "histogram": true, "summary": true}
+
+// mappingKeys returns the collection key of each mapped metric. The
+// _bucket, _sum and _count series of a metric mapped as a histogram or
+// summary follow its mapping unless they have their own.
+func mappingKeys(mappings map[string]Mapping) map[string]string {
+	keys := make(map[string]string, len(mappings))
+	for metric, m := range mappings {
+		if m.Type != "histogram" && m.Type != "summary" {
+			continue
+		}
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			keys[metric+suffix] = m.Collection
+		}
+	}
+	for metric, m := range mappings {
+		keys[metric] = m.Collection
+	}
+	return keys
+}
+
+// handleMetadata serves /api/v1/metadata with the type, help and unit of the
+// mapped metrics that declare them. It accepts the metric and limit
+// parameters of the Prometheus API.
+func handleMetadata(w http.ResponseWriter, r *http.Request) {
+	scope, err := resolveScope(r)
+	if err != nil {
+		sendScopeError(w, err)
+		return
+	}
+	limit := -1
+	if s := r.FormValue("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil {
+			sendJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid limit: %v", err))
+			return
+		}
+	}
+	metric := r.FormValue("metric")
+
+	data := map[string][]map[string]string{}
+	for _, name := range sortedKeys(scope.Mappings) {
+		if limit >= 0 && len(data) >= limit {
+			break
+		}
+		m := scope.Mappings[name]
+		if !m.hasMetadata() || (metric != "" && name != metric) {
+			continue
+		}
+		typ := m.Type
+		if typ == "" {
+			typ = string(model.MetricTypeUnknown)
+		}
+		data[name] = []map[string]string{{"type": typ, "help": m.Help, "unit": m.Unit}}
+	}
+	sendJSON(w, data)
+}
+
+// rateFunctions are the functions that are only meaningful on counters.
+var rateFunctions = map[string]bool{"rate": true, "irate": true, "increase": true}
+
+// ratedGauges returns the metrics declared as gauges that an expression
+// applies rate(), irate() or increase() to.
+func ratedGauges(expr parser.Expr, mappings map[string]Mapping) []string {
+	var gauges []string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		call, ok := node.(*parser.Call)
+		if !ok || !rateFunctions[call.Func.Name] {
+			return nil
+		}
+		parser.Inspect(call, func(node parser.Node, _ []parser.Node) error {
+			if vs, ok := node.(*parser.VectorSelector); ok {
+				if name := selectedMetric(vs.LabelMatchers); isGauge(mappings, name) {
+					gauges = append(gauges, name)
+				}
+			}
+			return nil
+		})
+		return nil
+	})
+	return gauges
+}
+
+// selectedMetric returns the metric name an equality matcher selects, if any.
+func selectedMetric(matchers []*labels.Matcher) string {
+	for _, m := range matchers {
+		if m.Name == model.MetricNameLabel && m.Type == labels.MatchEqual {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+func isGauge(mappings map[string]Mapping, metric string) bool {
+	m, ok := mappings[metric]
+	return ok && m.Type == "gauge"
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/prometheus/prometheus/util/annotations"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+)
+
+func TestMappingKeys(t *testing.T) {
+	mappings := map[string]Mapping{
+		"http_requests_total":           {Collection: "http"},
+		"http_request_duration_seconds": {Collection: "http", Type: "histogram"},
+		"rpc_duration_seconds":          {Collection: "rpc", Type: "summary"},
+		"rpc_duration_seconds_sum":      {Collection: "rpc_sums"},
+		"queue_length":                  {Collection: "queues", Type: "gauge"},
+	}
+	want := map[string]string{
+		"http_requests_total":                  "http",
+		"http_request_duration_seconds":        "http",
+		"http_request_duration_seconds_bucket": "http",
+		"http_request_duration_seconds_sum":    "http",
+		"http_request_duration_seconds_count":  "http",
+		"rpc_duration_seconds":                 "rpc",
+		"rpc_duration_seconds_bucket":          "rpc",
+		"rpc_duration_seconds_sum":             "rpc_sums",
+		"rpc_duration_seconds_count":           "rpc",
+		"queue_length":                         "queues",
+	}
+	if got := mappingKeys(mappings); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	collections := map[string]CollectionInfo{}
+	for _, key := range []string{"http", "rpc", "rpc_sums", "queues"} {
+		collections[key] = CollectionInfo{Collection: translate.Collection{Name: key}}
+	}
+	scope := &queryScope{Database: "metrics", Collections: collections, Mappings: mappings}
+
+	// Metric names come from the mapping keys, suffixed series included.
+	q := &mongoQuerier{scope: scope}
+	values, _, err := q.LabelValues(context.Background(), model.MetricNameLabel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(want) {
+		t.Errorf("got metric names %v", values)
+	}
+	for _, v := range values {
+		if _, ok := want[v]; !ok {
+			t.Errorf("unexpected metric name %q", v)
+		}
+	}
+
+	now := time.Now()
+	// The translator routes suffixed series to the collection of their metric.
+	for metric, key := range map[string]string{
+		"http_request_duration_seconds_count": "http",
+		"rpc_duration_seconds_bucket":         "rpc",
+		"rpc_duration_seconds_sum":            "rpc_sums",
+	} {
+		plan, err := scope.translator().Select([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, metric)}, now, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Reads) != 1 || plan.Reads[0].Key != key {
+			t.Errorf("%s: got reads %+v, want collection %q", metric, plan.Reads, key)
+		}
+	}
+	// Suffixes of metrics that are neither histograms nor summaries are not mapped.
+	plan, err := scope.translator().Select([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, "queue_length_count")}, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Reads) != 0 {
+		t.Errorf("queue_length_count: got reads %+v", plan.Reads)
+	}
+}
+
+func TestRateOfGaugeAnnotation(t *testing.T) {
+	defer func() { backendOverride = nil }()
+	mem := translate.NewMemory()
+	backendOverride = mem
+	coll := CollectionInfo{Collection: translate.Collection{Name: "metrics", TimeField: "ts", MetricField: "name", ValueField: "value", LabelsField: "labels"}}
+	scope := &queryScope{Database: "db", Collections: map[string]CollectionInfo{"metrics": coll}, Mappings: map[string]Mapping{
+		"process_open_fds":    {Collection: "metrics", Type: "gauge"},
+		"http_requests_total": {Collection: "metrics", Type: "counter"},
+	}}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := int64(0); i < 5; i++ {
+		doc := sampleToDoc(labels.FromStrings("__name__", "http_requests_total", "job", "api"), t0.Add(time.Duration(i)*time.Minute).UnixMilli(), float64(i), coll)
+		if err := mem.Insert(context.Background(), "db", "metrics", doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine := promqltest.NewTestEngine(t, false, 0, promqltest.DefaultMaxSamplesPerQuery)
+	for query, want := range map[string]bool{
+		"rate(process_open_fds[5m])":    true,
+		"max(process_open_fds)":         false,
+		"rate(http_requests_total[5m])": false,
+	} {
+		q, err := engine.NewInstantQuery(context.Background(), mongoQueryable{scope: scope}, nil, query, t0.Add(4*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := q.Exec(context.Background())
+		if res.Err != nil {
+			t.Fatalf("%s: %v", query, res.Err)
+		}
+		got := false
+		for _, err := range res.Warnings {
+			got = got || errors.Is(err, annotations.PossibleNonCounterInfo) && strings.Contains(err.Error(), `"process_open_fds"`)
+		}
+		if got != want {
+			t.Errorf("%s: got annotations %v, want the gauge annotation: %v", query, res.Warnings.AsErrors(), want)
+		}
+		q.Close()
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultMaxReconnectBackoff = 30 * time.Second
+	initialReconnectBackoff    = time.Second
+)
+
+// mongoConn is a MongoDB client and the work that started while it was current.
+type mongoConn struct {
+	client *mongo.Client
+	users  sync.WaitGroup
+}
+
+var (
+	// currentConn holds the live MongoDB client; it is swapped on reconnect.
+	currentConn *mongoConn
+	connMu      sync.RWMutex
+	// mongoHealthy is cleared by the connection monitor while MongoDB is unreachable.
+	mongoHealthy atomic.Bool
+	// shuttingDown is set once the server starts draining requests.
+	shuttingDown atomic.Bool
+	// backendOverride, when set, replaces MongoDB as the store queries read
+	// from, e.g. with a translate.Memory.
+	backendOverride translate.Backend
+)
+
+// mongoClient returns the MongoDB client currently in use.
+func mongoClient() *mongo.Client {
+	connMu.RLock()
+	defer connMu.RUnlock()
+	if currentConn == nil {
+		return nil
+	}
+	return currentConn.client
+}
+
+// setMongoClient makes c the current client and returns the connection it replaces.
+func setMongoClient(c *mongo.Client) *mongoConn {
+	connMu.Lock()
+	defer connMu.Unlock()
+	old := currentConn
+	currentConn = &mongoConn{client: c}
+	return old
+}
+
+// useMongo marks the start of work that may use the current client and
+// returns the function marking its end. A replaced client is only
+// disconnected once all work started while it was current has ended.
+func useMongo() (done func()) {
+	connMu.RLock()
+	defer connMu.RUnlock()
+	if currentConn == nil {
+		return func() {}
+	}
+	currentConn.users.Add(1)
+	return currentConn.users.Done
+}
+
+// withMongo holds the current client for the duration of each request.
+func withMongo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer useMongo()()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dataBackend returns the store queries read from.
+func dataBackend() translate.Backend {
+	if backendOverride != nil {
+		return backendOverride
+	}
+	return translate.NewMongo(mongoClient())
+}
+
+// connectMongo creates a client and verifies the connection with a ping.
+func connectMongo(ctx context.Context) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.MongoDB.Timeout)*time.Second)
+	defer cancel()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(conf.MongoDB.URI))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Ping(ctx, nil); err != nil {
+		_ = c.Disconnect(context.Background())
+		return nil, fmt.Errorf("ping failed: %w", err)
+	}
+	return c, nil
+}
+
+// monitorMongo pings MongoDB periodically until ctx is done. When a ping fails
+// the bridge is marked not ready and a new client is established with
+// exponential backoff; the old client is disconnected once the requests and
+// background work still using it have ended.
+func monitorMongo(ctx context.Context) {
+	interval := time.Duration(conf.MongoDB.HealthCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	maxBackoff := time.Duration(conf.MongoDB.MaxReconnectBackoff) * time.Second
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxReconnectBackoff
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := mongoClient().Ping(pingCtx, nil)
+		cancel()
+		if err == nil {
+			if !mongoHealthy.Swap(true) {
+				slog.Info("MongoDB connection restored")
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if mongoHealthy.Swap(false) {
+			slog.Error("Lost connection to MongoDB", "err", err)
+		}
+		reconnectMongo(ctx, maxBackoff)
+	}
+}
+
+// disconnectReplaced waits until nothing uses a replaced client any more and
+// disconnects it.
+func disconnectReplaced(old *mongoConn) {
+	if old == nil {
+		return
+	}
+	old.users.Wait()
+	if err := old.client.Disconnect(context.Background()); err != nil {
+		slog.Warn("Error disconnecting previous MongoDB client", "err", err)
+	}
+}
+
+// reconnectMongo replaces the current client, retrying with exponential backoff until it succeeds or ctx is done.
+func reconnectMongo(ctx context.Context, maxBackoff time.Duration) {
+	backoff := initialReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		c, err := connectMongo(ctx)
+		if err == nil {
+			old := setMongoClient(c)
+			mongoHealthy.Store(true)
+			slog.Info("Reconnected to MongoDB", "attempts", attempt)
+			go disconnectReplaced(old)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("MongoDB reconnect failed", "attempt", attempt, "retry_in", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
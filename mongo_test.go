@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestReplacedClientWaitsForUsers(t *testing.T) {
+	defer setMongoClient(nil)
+	// Connect does not dial; the clients never reach a server.
+	newClient := func() *mongo.Client {
+		c, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	first := newClient()
+	setMongoClient(first)
+	done := useMongo()
+	old := setMongoClient(newClient())
+	if old.client != first {
+		t.Fatal("setMongoClient did not return the replaced client")
+	}
+	// Work starting after the swap holds the new client only.
+	useMongo()()
+
+	disconnected := make(chan struct{})
+	go func() {
+		disconnectReplaced(old)
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+		t.Fatal("replaced client was disconnected while in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replaced client was not disconnected once unused")
+	}
+	mongoClient().Disconnect(context.Background())
+}
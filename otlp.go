@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// OTLPConfig configures the OTLP/HTTP metrics receiver on /v1/metrics.
+type OTLPConfig struct {
+	Enabled                   bool     `yaml:"enabled"`
+	Collection                string   `yaml:"collection"`                // collection key for metrics without a mapping; they are dropped if unset
+	PromoteResourceAttributes []string `yaml:"promoteResourceAttributes"` // resource attributes added as labels
+	ConvertDelta              bool     `yaml:"convertDelta"`              // accumulate delta sums and histograms into cumulative ones
+	Principals                []string `yaml:"principals"`                // authenticated users/tokens allowed to write; any if empty
+}
+
+// newOTLPHandler returns the /v1/metrics handler. It accepts OTLP/HTTP
+// export requests in protobuf or JSON and converts gauges, sums and
+// histograms into series named by the OpenTelemetry to Prometheus rules:
+// units and _total become suffixes and histograms become _bucket, _sum and
+// _count series. Each series is written to the collection its name is
+// mapped to in the caller's scope; series outside the caller's access policy
+// are dropped.
+func newOTLPHandler(cfg OTLPConfig) http.Handler {
+	logger := slog.Default().With("component", "otlp")
+	promCfg := func() config.Config {
+		c := config.DefaultConfig
+		c.OTLPConfig = config.DefaultOTLPConfig
+		c.OTLPConfig.PromoteResourceAttributes = cfg.PromoteResourceAttributes
+		return c
+	}
+	h := remote.NewOTLPWriteHandler(logger, nil, otlpAppendable{fallback: cfg.Collection}, promCfg, remote.OTLPOptions{ConvertDelta: cfg.ConvertDelta})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if principal := principalFromContext(r.Context()); len(cfg.Principals) > 0 && !slices.Contains(cfg.Principals, principal) {
+			sendJSONError(w, http.StatusForbidden, "unauthorized", fmt.Sprintf("%q may not write metrics", principal))
+			return
+		}
+		scope, err := resolveScope(r)
+		if err != nil {
+			sendScopeError(w, err)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(withScope(r.Context(), scope)))
+	})
+}
+
+// otlpAppendable writes into the collections of the scope in the context.
+type otlpAppendable struct {
+	fallback string
+}
+
+func (a otlpAppendable) Appender(ctx context.Context) storage.Appender {
+	scope := scopeFromContext(ctx)
+	dest := mongoAppendable{
+		database: scope.Database,
+		collInfo: scope.Collections[a.fallback],
+		routes:   otlpRoutes(scope),
+		fields:   scope.Fields,
+	}
+	return &otlpAppender{Appender: dest.Appender(ctx), matchers: scope.Matchers}
+}
+
+// otlpRoutes maps metric names to the collections of the scope.
+func otlpRoutes(scope *queryScope) map[string]CollectionInfo {
+	routes := map[string]CollectionInfo{}
+	for name, key := range mappingKeys(scope.Mappings) {
+		if collInfo, ok := scope.Collections[key]; ok {
+			routes[name] = collInfo
+		}
+	}
+	return routes
+}
+
+// otlpAppender drops series outside the writer's access policy, and the
+// native histograms that exponential histograms convert to rather than
+// failing the whole request.
+type otlpAppender struct {
+	storage.Appender
+	matchers []*labels.Matcher
+	denied   int // samples dropped for the access policy
+}
+
+func (a *otlpAppender) Append(ref storage.SeriesRef, l labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
+	if !matchesAll(l, a.matchers) {
+		a.denied++
+		return ref, nil
+	}
+	return a.Appender.Append(ref, l, t, v)
+}
+
+func (a *otlpAppender) Commit() error {
+	if a.denied > 0 {
+		slog.Warn("Dropped OTLP samples outside the access policy", "component", "otlp", "samples", a.denied)
+		a.denied = 0
+	}
+	return a.Appender.Commit()
+}
+
+func (a *otlpAppender) AppendHistogram(ref storage.SeriesRef, l labels.Labels, _ int64, _ *histogram.Histogram, _ *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	slog.Debug("Dropping OTLP exponential histogram", "component", "otlp", "series", l.String())
+	return ref, nil
+}
+
+func (a *otlpAppender) AppendHistogramCTZeroSample(ref storage.SeriesRef, _ labels.Labels, _, _ int64, _ *histogram.Histogram, _ *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	return ref, nil
+}
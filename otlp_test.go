@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+)
+
+// otlpTestMetrics returns a gauge, a monotonic sum, an explicit and an
+// exponential histogram of one service.
+func otlpTestMetrics(t0 time.Time) pmetric.Metrics {
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "api")
+	metrics := rm.ScopeMetrics().AppendEmpty().Metrics()
+	ts := pcommon.NewTimestampFromTime(t0)
+
+	gauge := metrics.AppendEmpty()
+	gauge.SetName("process.memory.usage")
+	gauge.SetUnit("By")
+	dp := gauge.SetEmptyGauge().DataPoints().AppendEmpty()
+	dp.SetTimestamp(ts)
+	dp.SetDoubleValue(1024)
+
+	sum := metrics.AppendEmpty()
+	sum.SetName("http.requests")
+	sum.SetUnit("{request}")
+	s := sum.SetEmptySum()
+	s.SetIsMonotonic(true)
+	s.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	dp = s.DataPoints().AppendEmpty()
+	dp.SetTimestamp(ts)
+	dp.SetIntValue(7)
+
+	hist := metrics.AppendEmpty()
+	hist.SetName("http.request.duration")
+	hist.SetUnit("s")
+	h := hist.SetEmptyHistogram()
+	h.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	hdp := h.DataPoints().AppendEmpty()
+	hdp.SetTimestamp(ts)
+	hdp.SetCount(3)
+	hdp.SetSum(0.6)
+	hdp.ExplicitBounds().FromRaw([]float64{0.1, 0.5})
+	hdp.BucketCounts().FromRaw([]uint64{1, 1, 1})
+
+	exp := metrics.AppendEmpty()
+	exp.SetName("rpc.duration")
+	exp.SetUnit("s")
+	e := exp.SetEmptyExponentialHistogram()
+	e.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	edp := e.DataPoints().AppendEmpty()
+	edp.SetTimestamp(ts)
+	edp.SetCount(2)
+	edp.SetSum(1)
+	edp.Positive().BucketCounts().FromRaw([]uint64{2})
+	return md
+}
+
+func TestOTLPReceiver(t *testing.T) {
+	defer func(saved Config, policies map[string][]*labels.Matcher) {
+		conf, accessPolicies, backendOverride = saved, policies, nil
+	}(conf, accessPolicies)
+	mem := translate.NewMemory()
+	backendOverride = mem
+	coll := func(name string) CollectionInfo {
+		return CollectionInfo{Collection: translate.Collection{Name: name, TimeField: "ts", MetricField: "name", ValueField: "value", LabelsField: "labels"}}
+	}
+	conf = Config{}
+	conf.MongoDB.Database = "metrics"
+	conf.Tenancy = TenancyConfig{Enabled: true, Mode: "field", TenantField: "tenant", AllowUnlisted: true}
+	conf.Collections = map[string]CollectionInfo{"http": coll("http"), "otel": coll("otel")}
+	conf.Mappings = map[string]Mapping{
+		"http_requests_total":           {Collection: "http", Type: "counter"},
+		"http_request_duration_seconds": {Collection: "http", Type: "histogram"},
+	}
+	accessPolicies = nil
+
+	t0 := time.Now().Truncate(time.Millisecond)
+	req := pmetricotlp.NewExportRequestFromMetrics(otlpTestMetrics(t0))
+	protoBody, err := req.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonBody, err := req.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(h http.Handler, tenant, contentType string, body []byte) int {
+		r := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		if tenant != "" {
+			r.Header.Set("X-Scope-OrgID", tenant)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	// names returns the metric names written to a collection for a tenant.
+	names := func(collection, tenant string) []string {
+		read := translate.Read{Database: "metrics", Collection: coll(collection).Collection, Fields: map[string]string{"tenant": tenant}}
+		cursor, err := mem.Find(context.Background(), read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for cursor.Next(context.Background()) {
+			var doc translate.Document
+			if err := cursor.Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, doc["name"].(string))
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	h := newOTLPHandler(OTLPConfig{Enabled: true, Collection: "otel"})
+	if code := post(h, "team-a", "application/x-protobuf", protoBody); code != http.StatusOK {
+		t.Fatalf("protobuf request: got status %d", code)
+	}
+	if code := post(h, "team-b", "application/json", jsonBody); code != http.StatusOK {
+		t.Fatalf("JSON request: got status %d", code)
+	}
+	wantHTTP := []string{
+		"http_request_duration_seconds_bucket", "http_request_duration_seconds_bucket", "http_request_duration_seconds_bucket",
+		"http_request_duration_seconds_count", "http_request_duration_seconds_sum", "http_requests_total",
+	}
+	for _, tenant := range []string{"team-a", "team-b"} {
+		if got := names("http", tenant); !slices.Equal(got, wantHTTP) {
+			t.Errorf("%s: http collection holds %v, want %v", tenant, got, wantHTTP)
+		}
+		if got := names("otel", tenant); !slices.Equal(got, []string{"process_memory_usage_bytes"}) {
+			t.Errorf("%s: fallback collection holds %v", tenant, got)
+		}
+	}
+
+	// Without a fallback collection unmapped metrics are dropped.
+	h = newOTLPHandler(OTLPConfig{Enabled: true})
+	if code := post(h, "team-c", "application/x-protobuf", protoBody); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if got := names("otel", "team-c"); len(got) != 0 {
+		t.Errorf("unmapped metrics were written without a fallback: %v", got)
+	}
+
+	// Series outside the writer's access policy are dropped.
+	accessPolicies = map[string][]*labels.Matcher{"": {labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")}}
+	if code := post(h, "team-d", "application/x-protobuf", protoBody); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if got := names("http", "team-d"); !slices.Equal(got, []string{"http_requests_total"}) {
+		t.Errorf("access policy: http collection holds %v", got)
+	}
+
+	if code := post(h, "", "application/x-protobuf", protoBody); code != http.StatusUnauthorized {
+		t.Errorf("request without a tenant: got status %d, want 401", code)
+	}
+	h = newOTLPHandler(OTLPConfig{Enabled: true, Principals: []string{"collector"}})
+	if code := post(h, "team-a", "application/x-protobuf", protoBody); code != http.StatusForbidden {
+		t.Errorf("principal not allowed to write: got status %d, want 403", code)
+	}
+}
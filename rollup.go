@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultRollupInterval        = time.Minute
+	defaultRollupDelay           = 2 * time.Minute
+	defaultRollupStateCollection = "rollup_state"
+	// rollupBatchBuckets bounds how many buckets one aggregation covers, so a
+	// long backfill progresses in steps and survives restarts.
+	rollupBatchBuckets = 288
+)
+
+// RollupInfo declares a downsampled copy of a collection. The rollup job
+// writes one document per series and bucket, with the collection's time,
+// metric and label fields, the bucket average in its valueField and the
+// min/max/sum/count of the raw values.
+type RollupInfo struct {
+	Name       string `yaml:"name"`       // MongoDB collection name
+	Resolution int    `yaml:"resolution"` // bucket size in seconds
+	MinField   string `yaml:"minField"`   // defaults to min
+	MaxField   string `yaml:"maxField"`   // defaults to max
+	SumField   string `yaml:"sumField"`   // defaults to sum
+	CountField string `yaml:"countField"` // defaults to count
+}
+
+// RollupsConfig configures the background job maintaining rollup collections.
+type RollupsConfig struct {
+	Interval        int    `yaml:"interval"`        // seconds between runs
+	Delay           int    `yaml:"delay"`           // seconds after a bucket ends before it is rolled up, to allow for late writes
+	StateCollection string `yaml:"stateCollection"` // collection recording how far each rollup is complete
+}
+
+func (r RollupInfo) resolution() time.Duration {
+	return time.Duration(r.Resolution) * time.Second
+}
+
+// withDefaults fills in the default aggregate field names.
+func (r RollupInfo) withDefaults() RollupInfo {
+	if r.MinField == "" {
+		r.MinField = "min"
+	}
+	if r.MaxField == "" {
+		r.MaxField = "max"
+	}
+	if r.SumField == "" {
+		r.SumField = "sum"
+	}
+	if r.CountField == "" {
+		r.CountField = "count"
+	}
+	return r
+}
+
+// rollupFor returns the coarsest rollup whose resolution is not coarser than
+// the requested one.
+func (c CollectionInfo) rollupFor(resolution time.Duration) (RollupInfo, bool) {
+	var best RollupInfo
+	found := false
+	for _, r := range c.Rollups {
+		if r.Resolution > 0 && r.resolution() <= resolution && (!found || r.Resolution > best.Resolution) {
+			best, found = r, true
+		}
+	}
+	return best.withDefaults(), found
+}
+
+// rollupCollection describes a rollup as a collection with the raw layout.
+// Samples read from it carry the bucket average, or the bucket minimum,
+// maximum or sum for min_over_time, max_over_time and sum_over_time. Rollups
+// hold transformed values already.
+func (c CollectionInfo) rollupCollection(r RollupInfo, fn string) CollectionInfo {
+	c.Name = r.Name
+	c.Rollups = nil
+	c.ValueTransform = translate.ValueTransform{}
+	switch fn {
+	case "min_over_time":
+		c.ValueField = r.MinField
+	case "max_over_time":
+		c.ValueField = r.MaxField
+	case "sum_over_time":
+		c.ValueField = r.SumField
+	}
+	return c
+}
+
+// readPart is a half-open time range of a query served by one collection.
+type readPart struct {
+	collInfo   CollectionInfo
+	start, end time.Time
+	resolution time.Duration // bucket size when read from a rollup, 0 for raw data
+}
+
+// planRead decides which collections serve [start, end) of a collection
+// queried at the given resolution: the coarsest fitting rollup up to its
+// watermark and the raw collection for the rest. fn is the PromQL function
+// wrapping the selector, if known.
+func (s *queryScope) planRead(collInfo CollectionInfo, start, end time.Time, resolution time.Duration, fn string) []readPart {
+	raw := []readPart{{collInfo: collInfo, start: start, end: end}}
+	// Rollups are only maintained in the global database, and counting
+	// samples needs the raw ones.
+	if s.Database != conf.MongoDB.Database || fn == "count_over_time" {
+		return raw
+	}
+	r, ok := collInfo.rollupFor(resolution)
+	if !ok {
+		return raw
+	}
+	wm := rollupWatermark(r.Name)
+	if !wm.After(start) {
+		return raw
+	}
+	parts := []readPart{{collInfo: collInfo.rollupCollection(r, fn), start: start, end: earlierOf(wm, end), resolution: r.resolution()}}
+	if end.After(wm) {
+		parts = append(parts, readPart{collInfo: collInfo, start: wm, end: end})
+	}
+	return parts
+}
+
+// partsSource identifies the collections and time ranges parts are read
+// from, so that results read from a rollup are cached apart from raw ones.
+func partsSource(parts []readPart) string {
+	var b strings.Builder
+	for _, p := range parts {
+		fmt.Fprintf(&b, "%s@%d-%d;", p.collInfo.Name, p.start.UnixNano(), p.end.UnixNano())
+	}
+	return b.String()
+}
+
+// rollupWarning tells the caller of a range query that samples of a part
+// are bucket averages rather than raw samples.
+func (p readPart) rollupWarning() string {
+	return fmt.Sprintf("samples from %s to %s are %s averages read from rollup %q, as the step is at least its resolution",
+		p.start.UTC().Format(time.RFC3339), p.end.UTC().Format(time.RFC3339), p.resolution, p.collInfo.Name)
+}
+
+// mergeRollupPart extends the part of parts read from the same rollup by
+// part, or adds it.
+func mergeRollupPart(parts []readPart, part readPart) []readPart {
+	for i, p := range parts {
+		if p.collInfo.Name == part.collInfo.Name {
+			parts[i].start, parts[i].end = earlierOf(p.start, part.start), laterOf(p.end, part.end)
+			return parts
+		}
+	}
+	return append(parts, part)
+}
+
+// read narrows a read of the queried collection to this part.
+func (p readPart) read(base translate.Read) translate.Read {
+	base.Collection = p.collInfo.Collection
+	base.Start, base.End = p.start, p.end
+	return base
+}
+
+var (
+	watermarksMu sync.RWMutex
+	// watermarks holds, per rollup collection, the end of the last complete bucket.
+	watermarks = map[string]time.Time{}
+)
+
+func rollupWatermark(name string) time.Time {
+	watermarksMu.RLock()
+	defer watermarksMu.RUnlock()
+	return watermarks[name]
+}
+
+func setRollupWatermark(name string, t time.Time) {
+	watermarksMu.Lock()
+	watermarks[name] = t
+	watermarksMu.Unlock()
+}
+
+// validateRollups checks the rollup declarations at startup.
+func validateRollups(collections map[string]CollectionInfo) error {
+	seen := map[string]string{}
+	for key, c := range collections {
+		for _, r := range c.Rollups {
+			if r.Name == "" || r.Resolution <= 0 {
+				return fmt.Errorf("collection %q: rollups need a name and a positive resolution", key)
+			}
+			if c.TimeField == "" || c.ValueField == "" {
+				return fmt.Errorf("collection %q: rollups need timeField and valueField", key)
+			}
+			if other, dup := seen[r.Name]; dup {
+				return fmt.Errorf("rollup collection %q is used by %q and %q", r.Name, other, key)
+			}
+			seen[r.Name] = key
+		}
+	}
+	return nil
+}
+
+// runRollups maintains all declared rollup collections until ctx is done.
+func runRollups(ctx context.Context) {
+	cfg := conf.Rollups
+	var keys []string
+	for key, c := range conf.Collections {
+		if len(c.Rollups) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	state := cfg.StateCollection
+	if state == "" {
+		state = defaultRollupStateCollection
+	}
+	logger := slog.Default().With("component", "rollups")
+	delay := secondsOr(cfg.Delay, defaultRollupDelay)
+	loaded := false
+
+	ticker := time.NewTicker(secondsOr(cfg.Interval, defaultRollupInterval))
+	defer ticker.Stop()
+	for {
+		if mongoHealthy.Load() {
+			done := useMongo()
+			if !loaded {
+				loaded = loadWatermarks(ctx, state, logger) == nil
+			}
+			if loaded {
+				for _, key := range keys {
+					collInfo := conf.Collections[key]
+					for _, r := range collInfo.Rollups {
+						if err := updateRollup(ctx, collInfo, r.withDefaults(), state, delay); err != nil && ctx.Err() == nil {
+							logger.Error("Error updating rollup", "collection", key, "rollup", r.Name, "err", err)
+						}
+					}
+				}
+			}
+			done()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadWatermarks restores the rollup progress recorded in MongoDB.
+func loadWatermarks(ctx context.Context, state string, logger *slog.Logger) error {
+	cursor, err := mongoClient().Database(conf.MongoDB.Database).Collection(state).Find(ctx, bson.M{})
+	if err != nil {
+		logger.Warn("Could not load rollup state", "err", err)
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc struct {
+			Name      string    `bson:"_id"`
+			Watermark time.Time `bson:"watermark"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		setRollupWatermark(doc.Name, doc.Watermark)
+	}
+	return cursor.Err()
+}
+
+// updateRollup aggregates all complete buckets after the rollup's watermark,
+// one batch at a time. Buckets are merged by series and bucket start, so a
+// batch that is repeated after a failure overwrites its own output.
+func updateRollup(ctx context.Context, collInfo CollectionInfo, r RollupInfo, state string, delay time.Duration) error {
+	db := mongoClient().Database(conf.MongoDB.Database)
+	res := r.resolution()
+	until := time.Now().Add(-delay).Truncate(res).UTC()
+
+	from := rollupWatermark(r.Name)
+	if from.IsZero() {
+		// First run: start with the bucket of the oldest raw document.
+		var first bson.M
+		err := db.Collection(collInfo.Name).FindOne(ctx, bson.M{collInfo.TimeField: bson.M{"$type": "date"}},
+			options.FindOne().SetSort(bson.D{{Key: collInfo.TimeField, Value: 1}})).Decode(&first)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t, ok := first[collInfo.TimeField].(time.Time)
+		if !ok {
+			return nil
+		}
+		from = t.Truncate(res).UTC()
+	}
+
+	for from.Before(until) && ctx.Err() == nil {
+		to := earlierOf(from.Add(rollupBatchBuckets*res), until)
+		cursor, err := db.Collection(collInfo.Name).Aggregate(ctx, rollupPipeline(collInfo, r, from, to))
+		if err != nil {
+			return err
+		}
+		cursor.Close(ctx)
+		_, err = db.Collection(state).UpdateOne(ctx, bson.M{"_id": r.Name},
+			bson.M{"$set": bson.M{"watermark": to}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+		setRollupWatermark(r.Name, to)
+		from = to
+	}
+	return nil
+}
+
+// rollupPipeline aggregates the raw documents in [from, to) into buckets and
+// merges them into the rollup collection.
+func rollupPipeline(collInfo CollectionInfo, r RollupInfo, from, to time.Time) mongo.Pipeline {
+	tf := "$" + collInfo.TimeField
+	value := collInfo.ValueTransform.Expression(bson.M{"$convert": bson.M{"input": "$" + collInfo.ValueField, "to": "double", "onError": nil, "onNull": nil}})
+
+	// Series are identified by the metric, label and tenant fields. Group keys
+	// may not contain dots, so fields are numbered.
+	fields := []string{}
+	if collInfo.MetricField != "" {
+		fields = append(fields, collInfo.MetricField)
+	}
+	for _, f := range collInfo.LabelFields {
+		fields = append(fields, f)
+	}
+	if collInfo.LabelsField != "" {
+		fields = append(fields, collInfo.LabelsField)
+	}
+	for _, d := range collInfo.DerivedLabels {
+		fields = append(fields, d.Fields()...)
+	}
+	if conf.Tenancy.Enabled && conf.Tenancy.Mode == "field" {
+		fields = append(fields, conf.Tenancy.TenantField)
+	}
+	sort.Strings(fields)
+	fields = slices.Compact(fields)
+	// A field inside another grouped field, such as a derived label's source
+	// in the labels subdocument, is kept with it.
+	var outer []string
+	for _, f := range fields {
+		if !slices.ContainsFunc(fields, func(g string) bool { return strings.HasPrefix(f, g+".") }) {
+			outer = append(outer, f)
+		}
+	}
+	fields = outer
+
+	id := bson.M{"t": bson.M{"$subtract": bson.A{tf, bson.M{"$mod": bson.A{bson.M{"$toLong": tf}, r.resolution().Milliseconds()}}}}}
+	project := bson.D{{Key: collInfo.TimeField, Value: "$_id.t"}}
+	for i, f := range fields {
+		k := fmt.Sprintf("f%d", i)
+		id[k] = "$" + f
+		project = append(project, bson.E{Key: f, Value: "$_id." + k})
+	}
+	project = append(project,
+		bson.E{Key: collInfo.ValueField, Value: bson.M{"$divide": bson.A{"$sum", "$count"}}},
+		bson.E{Key: r.MinField, Value: "$min"},
+		bson.E{Key: r.MaxField, Value: "$max"},
+		bson.E{Key: r.SumField, Value: "$sum"},
+		bson.E{Key: r.CountField, Value: "$count"},
+	)
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: translate.MergeFilters(translate.TimeRangeFilter(collInfo.TimeField, from, to), bson.M{collInfo.TimeField: bson.M{"$type": "date"}})}},
+		{{Key: "$addFields", Value: bson.M{"_rollupValue": value}}},
+		{{Key: "$match", Value: bson.M{"_rollupValue": bson.M{"$ne": nil}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   id,
+			"min":   bson.M{"$min": "$_rollupValue"},
+			"max":   bson.M{"$max": "$_rollupValue"},
+			"sum":   bson.M{"$sum": "$_rollupValue"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$project", Value: project}},
+		{{Key: "$merge", Value: bson.M{"into": r.Name, "on": "_id", "whenMatched": "replace", "whenNotMatched": "insert"}}},
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+)
+
+const (
+	defaultEvaluationInterval = time.Minute
+	defaultRuleQueryTimeout   = 2 * time.Minute
+	defaultRuleMaxSamples     = 50000000
+	defaultOutageTolerance    = time.Hour
+	defaultForGracePeriod     = 10 * time.Minute
+	defaultResendDelay        = time.Minute
+)
+
+// RulesConfig configures the rule engine. Rule files use the Prometheus
+// format; results are written to OutputCollection, a key of collections.
+type RulesConfig struct {
+	Files              []string `yaml:"files"`              // rule files, glob patterns allowed
+	EvaluationInterval int      `yaml:"evaluationInterval"` // seconds, for groups without their own interval
+	OutputCollection   string   `yaml:"outputCollection"`   // collection key that receives recorded series
+
+	// Alerting
+	AlertmanagerURL      string `yaml:"alertmanagerURL"`      // Alertmanager base URL; alerts are evaluated either way but only sent when set
+	ExternalURL          string `yaml:"externalURL"`          // prefix of the generatorURL sent with alerts
+	AlertStateCollection string `yaml:"alertStateCollection"` // collection key for ALERTS/ALERTS_FOR_STATE, defaults to outputCollection
+	OutageTolerance      int    `yaml:"outageTolerance"`      // seconds; max downtime after which pending state is not restored
+	ForGracePeriod       int    `yaml:"forGracePeriod"`       // seconds; minimum 'for' duration applied after a restore
+	ResendDelay          int    `yaml:"resendDelay"`          // seconds between re-sending firing alerts
+}
+
+// ruleManager evaluates the configured rules; nil when no rule files are configured.
+var ruleManager *rules.Manager
+
+// ruleMappings maps the alert state series and the recorded metric names
+// without a mapping of their own; the global scope adds them to the
+// configured mappings.
+var ruleMappings map[string]Mapping
+
+// startRuleManager loads the rule files and starts periodic evaluation; it is
+// stopped with stopRuleManager. Recorded metric names without an explicit mapping are mapped to
+// the output collection so they can be queried like any other metric.
+func startRuleManager(ctx context.Context) error {
+	cfg := conf.Rules
+	if len(cfg.Files) == 0 {
+		return nil
+	}
+	outInfo, ok := conf.Collections[cfg.OutputCollection]
+	if !ok {
+		return fmt.Errorf("rules: outputCollection %q is not a configured collection", cfg.OutputCollection)
+	}
+	alertStateKey := cfg.AlertStateCollection
+	if alertStateKey == "" {
+		alertStateKey = cfg.OutputCollection
+	}
+	alertStateInfo, ok := conf.Collections[alertStateKey]
+	if !ok {
+		return fmt.Errorf("rules: alertStateCollection %q is not a configured collection", alertStateKey)
+	}
+	// Recorded series and ALERTS/ALERTS_FOR_STATE carry arbitrary labels, which
+	// are only read back from the labels subdocument.
+	if outInfo.LabelsField == "" {
+		return fmt.Errorf("rules: output collection %q needs a labelsField", cfg.OutputCollection)
+	}
+	if alertStateInfo.LabelsField == "" {
+		return fmt.Errorf("rules: alert state collection %q needs a labelsField", alertStateKey)
+	}
+
+	var files []string
+	for _, pattern := range cfg.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("rules: invalid file pattern %q: %w", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+
+	logger := slog.Default().With("component", "rules")
+	scope := globalScope()
+	queryable := mongoQueryable{scope: scope}
+	engine := promql.NewEngine(promql.EngineOpts{
+		Logger:               logger,
+		MaxSamples:           defaultRuleMaxSamples,
+		Timeout:              defaultRuleQueryTimeout,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+	// Alert state series are routed to their own collection and mapped so the
+	// rule manager can query them when restoring 'for' state after a restart.
+	routes := map[string]CollectionInfo{}
+	mappings := map[string]Mapping{}
+	for _, name := range alertStateMetrics {
+		routes[name] = alertStateInfo
+		mappings[name] = Mapping{Collection: alertStateKey}
+	}
+
+	opts := &rules.ManagerOptions{
+		Context:         ctx,
+		Appendable:      mongoAppendable{database: scope.Database, collInfo: outInfo, routes: routes},
+		Queryable:       queryable,
+		QueryFunc:       rules.EngineQueryFunc(engine, queryable),
+		Logger:          logger,
+		OutageTolerance: secondsOr(cfg.OutageTolerance, defaultOutageTolerance),
+		ForGracePeriod:  secondsOr(cfg.ForGracePeriod, defaultForGracePeriod),
+		ResendDelay:     secondsOr(cfg.ResendDelay, defaultResendDelay),
+		NotifyFunc:      func(context.Context, string, ...*rules.Alert) {},
+	}
+	if cfg.AlertmanagerURL != "" {
+		opts.NotifyFunc = newAlertmanagerNotifier(cfg.AlertmanagerURL, cfg.ExternalURL).notify
+	}
+	mgr := rules.NewManager(opts)
+
+	interval := secondsOr(cfg.EvaluationInterval, defaultEvaluationInterval)
+	if err := mgr.Update(interval, files, labels.EmptyLabels(), cfg.ExternalURL, nil); err != nil {
+		return fmt.Errorf("rules: %w", err)
+	}
+	for _, rule := range mgr.Rules() {
+		for _, metric := range ratedGauges(rule.Query(), conf.Mappings) {
+			logger.Warn("Rule applies a counter function to a gauge", "rule", rule.Name(), "metric", metric)
+		}
+		if _, ok := rule.(*rules.RecordingRule); !ok {
+			continue
+		}
+		if _, mapped := conf.Mappings[rule.Name()]; !mapped {
+			mappings[rule.Name()] = Mapping{Collection: cfg.OutputCollection}
+		}
+	}
+	// Groups only start evaluating once the manager runs.
+	ruleMappings = mappings
+	scope.Mappings = mergeMaps(conf.Mappings, ruleMappings)
+
+	ruleManager = mgr
+	go mgr.Run()
+	slog.Info("Rule manager started", "files", len(files), "groups", len(mgr.RuleGroups()))
+	return nil
+}
+
+// stopRuleManager stops rule evaluation and waits for running evaluations to finish.
+func stopRuleManager() {
+	if ruleManager != nil {
+		ruleManager.Stop()
+	}
+}
+
+// ruleScope resolves the scope of a rules or alerts request. Rules are
+// evaluated over the global scope, so their results are not served to
+// tenants; the caller's access policy matchers filter the alerts.
+func ruleScope(r *http.Request) (*queryScope, error) {
+	scope, err := resolveScope(r)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Tenancy.Enabled {
+		return nil, fmt.Errorf("%w: rules are evaluated across all tenants", errTenantDenied)
+	}
+	return scope, nil
+}
+
+// handleRules serves /api/v1/rules in the Prometheus API format.
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	scope, err := ruleScope(r)
+	if err != nil {
+		sendScopeError(w, err)
+		return
+	}
+	typ := r.URL.Query().Get("type")
+	if typ != "" && typ != "record" && typ != "alert" {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid rule type %q", typ))
+		return
+	}
+	groups := []interface{}{}
+	if ruleManager != nil {
+		for _, g := range ruleManager.RuleGroups() {
+			ruleList := []interface{}{}
+			for _, rule := range g.Rules() {
+				var entry map[string]interface{}
+				switch rule := rule.(type) {
+				case *rules.RecordingRule:
+					if typ == "alert" {
+						continue
+					}
+					entry = map[string]interface{}{
+						"type":   "recording",
+						"name":   rule.Name(),
+						"query":  rule.Query().String(),
+						"labels": rule.Labels().Map(),
+					}
+				case *rules.AlertingRule:
+					if typ == "record" {
+						continue
+					}
+					entry = alertingRuleJSON(rule, scope.Matchers)
+				default:
+					continue
+				}
+				entry["health"] = rule.Health()
+				entry["lastError"] = errString(rule.LastError())
+				entry["evaluationTime"] = rule.GetEvaluationDuration().Seconds()
+				entry["lastEvaluation"] = rule.GetEvaluationTimestamp()
+				ruleList = append(ruleList, entry)
+			}
+			groups = append(groups, map[string]interface{}{
+				"name":           g.Name(),
+				"file":           g.File(),
+				"interval":       g.Interval().Seconds(),
+				"limit":          g.Limit(),
+				"rules":          ruleList,
+				"evaluationTime": g.GetEvaluationTime().Seconds(),
+				"lastEvaluation": g.GetLastEvaluation(),
+			})
+		}
+	}
+	sendJSON(w, map[string]interface{}{"groups": groups})
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultReadTimeout     = 30 * time.Second
+	defaultWriteTimeout    = 2 * time.Minute
+	defaultIdleTimeout     = 2 * time.Minute
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// secondsOr converts a config value in seconds to a duration, using def when unset.
+func secondsOr(v int, def time.Duration) time.Duration {
+	if v <= 0 {
+		return def
+	}
+	return time.Duration(v) * time.Second
+}
+
+// runServer serves handler (over HTTPS when tlsCfg is set) until ctx is done,
+// then reports not ready for the shutdown delay, stops accepting connections
+// and waits for in-flight requests up to the shutdown timeout.
+func runServer(ctx context.Context, handler http.Handler, tlsCfg *tls.Config) error {
+	srv := &http.Server{
+		Addr:         fmt.Sprintf("%s:%d", conf.Server.Host, conf.Server.Port),
+		Handler:      handler,
+		ReadTimeout:  secondsOr(conf.Server.ReadTimeout, defaultReadTimeout),
+		WriteTimeout: secondsOr(conf.Server.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:  secondsOr(conf.Server.IdleTimeout, defaultIdleTimeout),
+		ErrorLog:     slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		TLSConfig:    tlsCfg,
+	}
+	// Live tails never finish on their own; end them when draining starts.
+	srv.RegisterOnShutdown(stopStreams)
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("Server listening", "addr", srv.Addr, "tls", tlsCfg != nil)
+		if tlsCfg != nil {
+			errCh <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Flip readiness first and keep serving for the shutdown delay, so load
+	// balancers probing /-/ready stop routing new requests here before the
+	// listener closes.
+	shuttingDown.Store(true)
+	if delay := time.Duration(conf.Server.ShutdownDelay) * time.Second; delay > 0 {
+		slog.Info("Shutting down, reporting not ready", "delay", delay)
+		time.Sleep(delay)
+	}
+	timeout := secondsOr(conf.Server.ShutdownTimeout, defaultShutdownTimeout)
+	slog.Info("Shutting down, draining in-flight requests", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var shutdownErr error
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		shutdownErr = fmt.Errorf("draining requests: %w", err)
+		_ = srv.Close()
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		shutdownErr = errors.Join(shutdownErr, err)
+	}
+	return shutdownErr
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v3"
+)
+
+// Build information, set at build time via
+// -ldflags "-X main.version=... -X main.revision=... -X main.branch=... -X main.buildUser=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	revision  string
+	branch    string
+	buildUser string
+	buildDate string
+)
+
+const defaultReadyTimeout = 5 * time.Second
+
+// registerStatusHandlers adds the health, readiness and status endpoints to mux.
+func registerStatusHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/-/healthy", handleHealthy)
+	mux.HandleFunc("/-/ready", handleReady)
+	mux.HandleFunc("/api/v1/status/buildinfo", handleBuildInfo)
+	mux.HandleFunc("/api/v1/status/config", handleStatusConfig)
+	mux.HandleFunc("/api/v1/status/flags", handleStatusFlags)
+}
+
+// handleHealthy reports that the process is up; it never touches MongoDB.
+func handleHealthy(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "PromQL to MongoDB bridge is Healthy.")
+}
+
+// handleReady reports whether MongoDB is reachable and every configured collection exists.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := checkReady(r.Context()); err != nil {
+		loggerFromContext(r.Context()).Warn("Readiness check failed", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "PromQL to MongoDB bridge is not ready: %v\n", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "PromQL to MongoDB bridge is Ready.")
+}
+
+// checkReady pings MongoDB and verifies that all configured collections exist.
+func checkReady(ctx context.Context) error {
+	if shuttingDown.Load() {
+		return errors.New("shutting down")
+	}
+	if !mongoHealthy.Load() {
+		return errors.New("MongoDB is unreachable, reconnecting")
+	}
+	timeout := time.Duration(conf.Server.ReadyTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client := mongoClient()
+	if err := client.Ping(ctx, nil); err != nil {
+		return fmt.Errorf("ping failed: %w", err)
+	}
+	names, err := client.Database(conf.MongoDB.Database).ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return fmt.Errorf("listing collections: %w", err)
+	}
+	existing := make(map[string]bool, len(names))
+	for _, n := range names {
+		existing[n] = true
+	}
+	var missing []string
+	for _, info := range conf.Collections {
+		if !existing[info.Name] {
+			missing = append(missing, info.Name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing collections %v in database %q", missing, conf.MongoDB.Database)
+	}
+	return nil
+}
+
+func handleBuildInfo(w http.ResponseWriter, r *http.Request) {
+	rev, date := revision, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+	sendJSON(w, map[string]string{
+		"version":   version,
+		"revision":  rev,
+		"branch":    branch,
+		"buildUser": buildUser,
+		"buildDate": date,
+		"goVersion": runtime.Version(),
+	})
+}
+
+// handleStatusConfig returns the loaded configuration as YAML, with secrets,
+// tenant principals and access policy matchers redacted. Principals with an
+// access policy or listed for a tenant may not read it.
+func handleStatusConfig(w http.ResponseWriter, r *http.Request) {
+	if principal := principalFromContext(r.Context()); restrictedPrincipal(principal) {
+		sendJSONError(w, http.StatusForbidden, "unauthorized", fmt.Sprintf("%q may not read the configuration", principal))
+		return
+	}
+	redacted := conf
+	redacted.MongoDB.URI = redactURI(conf.MongoDB.URI)
+	redacted.Server.BasicAuthUsers = redactValues(conf.Server.BasicAuthUsers)
+	redacted.Server.BearerTokens = redactValues(conf.Server.BearerTokens)
+	if conf.Tenancy.Tenants != nil {
+		redacted.Tenancy.Tenants = make(map[string]TenantConfig, len(conf.Tenancy.Tenants))
+		for id, tc := range conf.Tenancy.Tenants {
+			if len(tc.Principals) > 0 {
+				tc.Principals = []string{"<secret>"}
+			}
+			redacted.Tenancy.Tenants[id] = tc
+		}
+	}
+	if conf.AccessPolicies != nil {
+		redacted.AccessPolicies = make(map[string]AccessPolicy, len(conf.AccessPolicies))
+		for principal := range conf.AccessPolicies {
+			redacted.AccessPolicies[principal] = AccessPolicy{Matchers: []string{"<secret>"}}
+		}
+	}
+	out, err := yaml.Marshal(redacted)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	sendJSON(w, map[string]string{"yaml": string(out)})
+}
+
+// restrictedPrincipal reports whether a principal is limited by an access
+// policy or to the tenants listing it.
+func restrictedPrincipal(principal string) bool {
+	if len(accessPolicies[principal]) > 0 {
+		return true
+	}
+	for _, tc := range conf.Tenancy.Tenants {
+		if slices.Contains(tc.Principals, principal) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleStatusFlags(w http.ResponseWriter, r *http.Request) {
+	flags := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	sendJSON(w, flags)
+}
+
+// redactValues returns a copy of m with every value replaced by a placeholder.
+func redactValues(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k := range m {
+		out[k] = "<secret>"
+	}
+	return out
+}
+
+// redactURI hides the password of a MongoDB connection string.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		slog.Debug("Could not parse MongoDB URI for redaction", "err", err)
+		return "<secret>"
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
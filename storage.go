@@ -0,0 +1,490 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/metadata"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/util/annotations"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mongoQueryable exposes the MongoDB collections of a scope as Prometheus
+// storage, so the upstream PromQL engine can evaluate full expressions (as the
+// rule manager does) against documents.
+type mongoQueryable struct {
+	scope *queryScope
+}
+
+func (q mongoQueryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	return &mongoQuerier{scope: q.scope, mint: mint, maxt: maxt}, nil
+}
+
+type mongoQuerier struct {
+	scope      *queryScope
+	mint, maxt int64
+}
+
+func (q *mongoQuerier) Select(ctx context.Context, _ bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	// Rule evaluations run outside any request.
+	defer useMongo()()
+	mint, maxt := q.mint, q.maxt
+	var resolution time.Duration
+	var fn string
+	if hints != nil {
+		mint, maxt = hints.Start, hints.End
+		resolution, fn = selectResolution(hints), hints.Func
+	}
+	series, err := selectSeries(ctx, q.scope, matchers, time.UnixMilli(mint), time.UnixMilli(maxt), resolution, fn)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	set := &seriesList{series: series, i: -1}
+	if metric := selectedMetric(matchers); rateFunctions[fn] && isGauge(q.scope.Mappings, metric) {
+		set.warnings.Add(annotations.NewPossibleNonCounterInfo(metric, posrange.PositionRange{}))
+	}
+	return set
+}
+
+// LabelValues returns the values of a label. Metric names come from the
+// mappings; other labels are read with distinct() on their mapped field.
+func (q *mongoQuerier) LabelValues(ctx context.Context, name string, _ *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	defer useMongo()()
+	seen := map[string]bool{}
+	if name == model.MetricNameLabel {
+		for metric := range mappingKeys(q.scope.Mappings) {
+			seen[metric] = true
+		}
+	} else {
+		// Both ends are inclusive; one millisecond past maxt includes it.
+		plan, err := q.scope.translator().Select(matchers, time.UnixMilli(q.mint), time.UnixMilli(q.maxt).Add(time.Millisecond))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, read := range plan.Reads {
+			if len(read.Collection.RelabelConfigs) > 0 {
+				if err := relabeledLabelValues(ctx, read, name, seen); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			if d, derived := read.Collection.DerivedLabel(name); derived {
+				if err := derivedLabelValues(ctx, read, d, seen); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			field, ok := read.Collection.LabelFields[name]
+			if !ok {
+				if v, ok := read.Collection.DefaultLbls[name]; ok {
+					seen[v] = true
+				}
+				continue
+			}
+			vals, err := dataBackend().Distinct(ctx, read, field)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, v := range vals {
+				seen[fmt.Sprintf("%v", v)] = true
+			}
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for v := range seen {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out, nil, nil
+}
+
+// derivedLabelValues adds the values of a derived label among the documents
+// of a read to seen. Labels from a single field use distinct() on it; others
+// are computed document by document.
+func derivedLabelValues(ctx context.Context, read translate.Read, d translate.DerivedLabel, seen map[string]bool) error {
+	if len(d.SourceFields) == 1 && d.Template == "" {
+		vals, err := dataBackend().Distinct(ctx, read, d.SourceFields[0])
+		if err != nil {
+			return err
+		}
+		for _, v := range vals {
+			if lv := d.Apply(fmt.Sprintf("%v", v)); lv != "" {
+				seen[lv] = true
+			}
+		}
+		return nil
+	}
+	cursor, err := dataBackend().Find(ctx, read)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc translate.Document
+		if err := cursor.Decode(&doc); err != nil {
+			continue
+		}
+		if lv := d.Value(doc); lv != "" {
+			seen[lv] = true
+		}
+	}
+	return cursor.Err()
+}
+
+// relabeledLabelValues adds the values of a label among the relabeled series
+// of a read to seen. Relabeling can compute a label from any other, so the
+// documents are read one by one.
+func relabeledLabelValues(ctx context.Context, read translate.Read, name string, seen map[string]bool) error {
+	cursor, err := dataBackend().Find(ctx, read)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc translate.Document
+		if err := cursor.Decode(&doc); err != nil {
+			continue
+		}
+		_, _, lbls, err := read.Collection.ExtractSample(doc)
+		if err != nil {
+			continue
+		}
+		if lv := lbls[name]; lv != "" {
+			seen[lv] = true
+		}
+	}
+	return cursor.Err()
+}
+
+// LabelNames returns the label names the matching collections can produce.
+func (q *mongoQuerier) LabelNames(_ context.Context, _ *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	seen := map[string]bool{model.MetricNameLabel: true}
+	for _, key := range q.scope.translator().CollectionKeys(matchers) {
+		for _, l := range q.scope.Collections[key].LabelNames() {
+			seen[l] = true
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for l := range seen {
+		out = append(out, l)
+	}
+	sort.Strings(out)
+	return out, nil, nil
+}
+
+func (q *mongoQuerier) Close() error { return nil }
+
+// selectResolution is the coarsest sample resolution that does not change the
+// result of a selection: the query step, and for range vectors at most half
+// the range so that rate() and friends still see two samples per window.
+// Instant queries (step 0) always read raw data.
+func selectResolution(hints *storage.SelectHints) time.Duration {
+	res := time.Duration(hints.Step) * time.Millisecond
+	if hints.Range > 0 {
+		res = min(res, time.Duration(hints.Range/2)*time.Millisecond)
+	}
+	return res
+}
+
+// selectSeries reads all samples matching the matchers between start and end
+// and returns them as series sorted by labels, with samples sorted by time.
+// Collections with rollups are read from the parts chosen by planRead for
+// the given resolution; fn is the function applied to the selection, if any.
+func selectSeries(ctx context.Context, scope *queryScope, matchers []*labels.Matcher, startTime, endTime time.Time, resolution time.Duration, fn string) ([]storage.Series, error) {
+	bySignature := map[string]*seriesSamples{}
+	scanned := 0
+	// Reads are half-open; one millisecond past endTime includes it.
+	plan, err := scope.translator().Select(matchers, startTime, endTime.Add(time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	for _, read := range plan.Reads {
+		for _, part := range scope.planRead(scope.Collections[read.Key], read.Start, read.End, resolution, fn) {
+			if err := scope.selectPart(ctx, part.read(read), matchers, bySignature, &scanned); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	out := make([]storage.Series, 0, len(bySignature))
+	for _, s := range bySignature {
+		out = append(out, storage.NewListSeries(s.lset, s.sorted()))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return labels.Compare(out[i].Labels(), out[j].Labels()) < 0
+	})
+	return out, nil
+}
+
+// selectPart reads the samples of one part of a selection into bySignature,
+// counting scanned documents against the scope's limits.
+func (s *queryScope) selectPart(ctx context.Context, read translate.Read, matchers []*labels.Matcher, bySignature map[string]*seriesSamples, scanned *int) error {
+	logger := loggerFromContext(ctx)
+	stats := queryStatsFromContext(ctx)
+	collInfo := read.Collection
+	logger.Debug("Selecting series", "collection", collInfo.Name, "filter", translate.Filter(read))
+	stats.addCollection(collInfo.Name)
+
+	cursor, err := dataBackend().Find(ctx, read)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		stats.addDocs(1)
+		*scanned++
+		if s.Limits.MaxDocuments > 0 && *scanned > s.Limits.MaxDocuments {
+			return fmt.Errorf("%w: more than %d documents scanned", errLimitExceeded, s.Limits.MaxDocuments)
+		}
+		var doc map[string]interface{}
+		if err := cursor.Decode(&doc); err != nil {
+			logger.Warn("Error decoding document", "err", err)
+			continue
+		}
+		ts, v, metricLabels, err := collInfo.ExtractSample(doc)
+		if err != nil {
+			if !errors.Is(err, translate.ErrDropped) {
+				logger.Warn("Error extracting data from doc", "err", err)
+			}
+			continue
+		}
+		lset := labels.FromMap(metricLabels)
+		if !matchesAll(lset, matchers) || !matchesAll(lset, s.Matchers) {
+			continue
+		}
+		sig := createLabelSignature(metricLabels)
+		series, ok := bySignature[sig]
+		if !ok {
+			if s.Limits.MaxSeries > 0 && len(bySignature) >= s.Limits.MaxSeries {
+				return fmt.Errorf("%w: more than %d series", errLimitExceeded, s.Limits.MaxSeries)
+			}
+			series = &seriesSamples{lset: lset}
+			bySignature[sig] = series
+		}
+		series.samples = append(series.samples, fSample{t: int64(math.Round(ts * 1000)), f: v})
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("cursor error: %w", err)
+	}
+	return nil
+}
+
+func matchesAll(lset labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+type seriesSamples struct {
+	lset    labels.Labels
+	samples []chunks.Sample
+}
+
+// sorted orders samples by time, keeping the last sample for duplicate timestamps.
+func (s *seriesSamples) sorted() []chunks.Sample {
+	slices.SortStableFunc(s.samples, func(a, b chunks.Sample) int {
+		return cmp.Compare(a.T(), b.T())
+	})
+	out := s.samples[:0]
+	for _, smpl := range s.samples {
+		if n := len(out); n > 0 && out[n-1].T() == smpl.T() {
+			out[n-1] = smpl
+			continue
+		}
+		out = append(out, smpl)
+	}
+	return out
+}
+
+// fSample is a float sample implementing chunks.Sample.
+type fSample struct {
+	t int64
+	f float64
+}
+
+func (s fSample) T() int64                      { return s.t }
+func (s fSample) F() float64                    { return s.f }
+func (s fSample) H() *histogram.Histogram       { return nil }
+func (s fSample) FH() *histogram.FloatHistogram { return nil }
+func (s fSample) Type() chunkenc.ValueType      { return chunkenc.ValFloat }
+func (s fSample) Copy() chunks.Sample           { return s }
+
+// seriesList is a storage.SeriesSet over an in-memory slice.
+type seriesList struct {
+	series   []storage.Series
+	i        int
+	warnings annotations.Annotations
+}
+
+func (s *seriesList) Next() bool                        { s.i++; return s.i < len(s.series) }
+func (s *seriesList) At() storage.Series                { return s.series[s.i] }
+func (s *seriesList) Err() error                        { return nil }
+func (s *seriesList) Warnings() annotations.Annotations { return s.warnings }
+
+// mongoAppendable writes samples into a collection using its CollectionInfo
+// layout. Samples whose metric name has an entry in routes go to that
+// collection instead; without a collInfo, other samples are dropped.
+type mongoAppendable struct {
+	database string
+	collInfo CollectionInfo
+	routes   map[string]CollectionInfo
+	fields   map[string]string // added to every document, e.g. a tenant ID
+}
+
+func (a mongoAppendable) Appender(ctx context.Context) storage.Appender {
+	return &mongoAppender{ctx: ctx, dest: a}
+}
+
+type mongoAppender struct {
+	ctx  context.Context
+	dest mongoAppendable
+	docs map[string][]translate.Document // collection name -> pending documents
+}
+
+func (a *mongoAppender) Append(ref storage.SeriesRef, l labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
+	// Staleness markers only matter to the Prometheus TSDB; documents simply stop appearing.
+	if value.IsStaleNaN(v) {
+		return ref, nil
+	}
+	collInfo, ok := a.dest.routes[l.Get(model.MetricNameLabel)]
+	if !ok {
+		collInfo = a.dest.collInfo
+	}
+	if collInfo.Name == "" {
+		return ref, nil
+	}
+	if a.docs == nil {
+		a.docs = map[string][]translate.Document{}
+	}
+	doc := sampleToDoc(l, t, v, collInfo)
+	for field, fieldValue := range a.dest.fields {
+		doc[field] = fieldValue
+	}
+	a.docs[collInfo.Name] = append(a.docs[collInfo.Name], doc)
+	return ref, nil
+}
+
+func (a *mongoAppender) Commit() error {
+	defer useMongo()()
+	pending := a.docs
+	a.docs = nil
+	var errs []error
+	for name, docs := range pending {
+		if err := dataBackend().Insert(a.ctx, a.dest.database, name, docs...); err != nil {
+			errs = append(errs, fmt.Errorf("writing to %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *mongoAppender) Rollback() error {
+	a.docs = nil
+	return nil
+}
+
+func (a *mongoAppender) SetOptions(*storage.AppendOptions) {}
+
+var errUnsupportedSample = errors.New("only float samples can be written to MongoDB")
+
+func (a *mongoAppender) AppendExemplar(ref storage.SeriesRef, _ labels.Labels, _ exemplar.Exemplar) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *mongoAppender) AppendHistogram(storage.SeriesRef, labels.Labels, int64, *histogram.Histogram, *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	return 0, errUnsupportedSample
+}
+
+func (a *mongoAppender) AppendHistogramCTZeroSample(storage.SeriesRef, labels.Labels, int64, int64, *histogram.Histogram, *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	return 0, errUnsupportedSample
+}
+
+func (a *mongoAppender) UpdateMetadata(ref storage.SeriesRef, _ labels.Labels, _ metadata.Metadata) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *mongoAppender) AppendCTZeroSample(ref storage.SeriesRef, _ labels.Labels, _, _ int64) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+// sampleToDoc converts a sample into a document following the collection's
+// field layout. Labels without a mapped field go into the labels subdocument,
+// or are stored under their own name when the collection has none; labels
+// equal to the collection's default value for that label are omitted, and so
+// are derived labels, which reads compute from the other fields. The value
+// is stored as the collection's value transform expects it.
+func sampleToDoc(l labels.Labels, t int64, v float64, collInfo CollectionInfo) translate.Document {
+	doc := translate.Document{}
+	translate.Set(doc, collInfo.TimeField, time.UnixMilli(t).UTC())
+	translate.Set(doc, collInfo.ValueField, collInfo.ValueTransform.Reverse(v))
+	extra := bson.M{}
+	if collInfo.LabelsField != "" {
+		translate.Set(doc, collInfo.LabelsField, extra)
+	}
+	l.Range(func(lbl labels.Label) {
+		if lbl.Name == model.MetricNameLabel && collInfo.MetricField != "" {
+			translate.Set(doc, collInfo.MetricField, lbl.Value)
+			return
+		}
+		if field, ok := collInfo.LabelFields[lbl.Name]; ok {
+			translate.Set(doc, field, lbl.Value)
+			return
+		}
+		if def, ok := collInfo.DefaultLbls[lbl.Name]; ok && def == lbl.Value {
+			return
+		}
+		if _, derived := collInfo.DerivedLabel(lbl.Name); derived {
+			return
+		}
+		if collInfo.LabelsField != "" {
+			extra[lbl.Name] = lbl.Value
+			return
+		}
+		doc[lbl.Name] = lbl.Value
+	})
+	return doc
+}
+
+// strayLabels returns the names of the labels sampleToDoc stores under their
+// own name because the collection has neither a labelFields entry for them
+// nor a labelsField. Reads never return these labels.
+func strayLabels(l labels.Labels, collInfo CollectionInfo) []string {
+	if collInfo.LabelsField != "" {
+		return nil
+	}
+	var names []string
+	l.Range(func(lbl labels.Label) {
+		if lbl.Name == model.MetricNameLabel && collInfo.MetricField != "" {
+			return
+		}
+		if _, ok := collInfo.LabelFields[lbl.Name]; ok {
+			return
+		}
+		if def, ok := collInfo.DefaultLbls[lbl.Name]; ok && def == lbl.Value {
+			return
+		}
+		if _, derived := collInfo.DerivedLabel(lbl.Name); derived {
+			return
+		}
+		names = append(names, lbl.Name)
+	})
+	return names
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const tailKeepAlive = 15 * time.Second
+
+// streamsCtx is cancelled when the server shuts down, ending all live tails
+// instead of letting them hold up the graceful shutdown.
+var streamsCtx, stopStreams = context.WithCancel(context.Background())
+
+// handleTail serves /api/v1/tail as a server-sent events stream. It takes a
+// series selector in the query parameter, watches the mapped collections with
+// a MongoDB change stream and sends every new matching sample as an event
+// with data {"metric": {...}, "value": [ts, "v"]}. Each event ID is the
+// change stream resume token: clients reconnecting with Last-Event-ID (or
+// ?resume=) continue right after the last event they received.
+func handleTail(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+	query := r.URL.Query().Get("query")
+	if query == "" {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", "empty query parameter")
+		return
+	}
+	matchers, err := parser.ParseMetricSelector(query)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	scope, err := resolveScope(r)
+	if err != nil {
+		logger.Info("Rejected tail", "err", err)
+		sendScopeError(w, err)
+		return
+	}
+	pipeline, sources, err := tailPipeline(scope, matchers)
+	if err != nil {
+		sendJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendJSONError(w, http.StatusInternalServerError, "internal", "streaming is not supported")
+		return
+	}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("resume")
+	}
+	if resume != "" {
+		opts.SetResumeAfter(bson.M{"_data": resume})
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(streamsCtx, cancel)
+	defer stop()
+
+	stream, err := mongoClient().Database(scope.Database).Watch(ctx, pipeline, opts)
+	if err != nil {
+		sendJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	defer stream.Close(context.Background())
+
+	// A tail runs for as long as the client listens; lift the server write timeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	logger.Info("Tail started", "query", query, "resumed", resume != "")
+
+	events := make(chan tailEvent)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- readTail(ctx, stream, sources, events)
+	}()
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev := <-events:
+			data, err := json.Marshal(ev.sample)
+			if err != nil {
+				logger.Warn("Error encoding tail event", "err", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: sample\ndata: %s\n\n", ev.token, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case err := <-errCh:
+			if err != nil && ctx.Err() == nil {
+				logger.Warn("Tail stream failed", "err", err)
+				msg, _ := json.Marshal(map[string]string{"error": err.Error()})
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", msg)
+				flusher.Flush()
+			}
+			logger.Info("Tail ended", "query", query)
+			return
+		}
+	}
+}
+
+type tailEvent struct {
+	token  string
+	sample map[string]interface{}
+}
+
+// tailSource is a watched collection and the matchers of its read, which
+// the samples of its change events must satisfy.
+type tailSource struct {
+	collInfo CollectionInfo
+	matchers []*labels.Matcher
+}
+
+// readTail decodes change events into samples until the stream ends.
+func readTail(ctx context.Context, stream *mongo.ChangeStream, sources map[string]tailSource, events chan<- tailEvent) error {
+	logger := loggerFromContext(ctx)
+	for stream.Next(ctx) {
+		var change struct {
+			ID           bson.M                 `bson:"_id"`
+			NS           struct{ Coll string }  `bson:"ns"`
+			FullDocument map[string]interface{} `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&change); err != nil {
+			logger.Warn("Error decoding change event", "err", err)
+			continue
+		}
+		source, ok := sources[change.NS.Coll]
+		if !ok || change.FullDocument == nil {
+			continue
+		}
+		timestamp, valueStr, metricLabels, err := source.collInfo.Extract(change.FullDocument)
+		if err != nil {
+			if !errors.Is(err, translate.ErrDropped) {
+				logger.Warn("Error extracting data from doc", "err", err)
+			}
+			continue
+		}
+		if !matchesAll(labels.FromMap(metricLabels), source.matchers) {
+			continue
+		}
+		token, _ := change.ID["_data"].(string)
+		ev := tailEvent{token: token, sample: map[string]interface{}{
+			"metric": metricLabels,
+			"value":  []interface{}{timestamp, valueStr},
+		}}
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return stream.Err()
+}
+
+// tailPipeline builds the change stream pipeline for a selector: inserted or
+// replaced documents in the collections holding the selected metrics, matching
+// the translated matchers of their collection. The sources are keyed by
+// collection name.
+func tailPipeline(scope *queryScope, matchers []*labels.Matcher) (mongo.Pipeline, map[string]tailSource, error) {
+	plan, err := scope.translator().Select(matchers, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plan.Reads) == 0 {
+		return nil, nil, fmt.Errorf("no collection holds metrics matching %s", selectorString(matchers))
+	}
+	sources := map[string]tailSource{}
+	var perCollection []interface{}
+	for _, read := range plan.Reads {
+		collInfo := scope.Collections[read.Key]
+		if _, dup := sources[collInfo.Name]; dup {
+			continue
+		}
+		// Like the reads of queries, these leave out __name__ for collections
+		// selected by mapping that store no metric name, and include the
+		// access policy matchers.
+		sources[collInfo.Name] = tailSource{collInfo: collInfo, matchers: read.Matchers}
+		filter := prefixFilter(translate.Filter(read), "fullDocument.")
+		perCollection = append(perCollection, translate.MergeFilters(map[string]interface{}{"ns.coll": collInfo.Name}, filter))
+	}
+	match := bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "replace"}},
+		"$or":           perCollection,
+	}
+	return mongo.Pipeline{{{Key: "$match", Value: match}}}, sources, nil
+}
+
+// prefixFilter rewrites the field names of a MongoDB filter to refer to a
+// subdocument, descending into $and, $or and $nor.
+func prefixFilter(filter map[string]interface{}, prefix string) map[string]interface{} {
+	out := make(map[string]interface{}, len(filter))
+	for k, v := range filter {
+		if !strings.HasPrefix(k, "$") {
+			out[prefix+k] = v
+			continue
+		}
+		if list, ok := v.([]interface{}); ok {
+			rewritten := make([]interface{}, len(list))
+			for i, item := range list {
+				if sub, ok := item.(map[string]interface{}); ok {
+					rewritten[i] = prefixFilter(sub, prefix)
+				} else {
+					rewritten[i] = item
+				}
+			}
+			v = rewritten
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// selectorString formats matchers as a series selector.
+func selectorString(matchers []*labels.Matcher) string {
+	parts := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		parts = append(parts, m.String())
+	}
+	sort.Strings(parts)
+	return "{" + strings.Join(parts, ", ") + "}"
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+)
+
+const defaultTenantHeader = "X-Scope-OrgID"
+
+// TenancyConfig enables serving several teams from one bridge. The tenant is
+// taken from a request header and either selects the MongoDB database
+// ("database" mode) or adds a mandatory filter on a tenant field to every
+// query ("field" mode).
+type TenancyConfig struct {
+	Enabled        bool                    `yaml:"enabled"`
+	Header         string                  `yaml:"header"`         // defaults to X-Scope-OrgID
+	Mode           string                  `yaml:"mode"`           // database or field
+	TenantField    string                  `yaml:"tenantField"`    // document field holding the tenant ID in field mode
+	AllowUnlisted  bool                    `yaml:"allowUnlisted"`  // accept tenants that are not listed under tenants
+	DatabasePrefix string                  `yaml:"databasePrefix"` // database mode: prefixed to the ID of unlisted tenants
+	Tenants        map[string]TenantConfig `yaml:"tenants"`
+}
+
+// TenantConfig holds per-tenant overrides of the global configuration.
+type TenantConfig struct {
+	Database    string                    `yaml:"database"`    // database mode: defaults to the tenant ID
+	FieldValue  string                    `yaml:"fieldValue"`  // field mode: defaults to the tenant ID
+	Principals  []string                  `yaml:"principals"`  // authenticated users/tokens allowed to act as this tenant
+	Collections map[string]CollectionInfo `yaml:"collections"` // added to or replacing the global collections
+	Mappings    map[string]Mapping        `yaml:"mappings"`    // added to or replacing the global mappings
+	Limits      TenantLimits              `yaml:"limits"`
+}
+
+// TenantLimits bounds the work a single query may cause. Zero means unlimited.
+type TenantLimits struct {
+	MaxDocuments   int `yaml:"maxDocuments"`   // documents scanned per query
+	MaxSeries      int `yaml:"maxSeries"`      // series returned per query
+	MaxQueryLength int `yaml:"maxQueryLength"` // seconds between start and end of a range query
+}
+
+// validTenantID restricts tenant IDs to characters that are safe in database names.
+var validTenantID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,63}$`)
+
+var validDatabasePrefix = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// reservedDatabases are the MongoDB system databases.
+var reservedDatabases = []string{"admin", "local", "config"}
+
+var (
+	errLimitExceeded = errors.New("query limit exceeded")
+	errNoTenant      = errors.New("no tenant ID")
+	errTenantDenied  = errors.New("tenant access denied")
+)
+
+// queryScope is the per-request view of the configuration: which database,
+// collections and mappings a caller may use and which filters are mandatory.
+type queryScope struct {
+	Tenant      string
+	Database    string
+	Collections map[string]CollectionInfo
+	Mappings    map[string]Mapping
+	Fields      map[string]string // document fields every read requires
+	Matchers    []*labels.Matcher // access policy matchers added to every selector
+	Limits      TenantLimits
+}
+
+// globalScope is the scope used when multi-tenancy is disabled.
+func globalScope() *queryScope {
+	return &queryScope{
+		Database:    conf.MongoDB.Database,
+		Collections: withGlobalRelabeling(conf.Collections),
+		Mappings:    mergeMaps(conf.Mappings, ruleMappings),
+	}
+}
+
+// withGlobalRelabeling returns the collections with the global relabel
+// configs appended to their own.
+func withGlobalRelabeling(collections map[string]CollectionInfo) map[string]CollectionInfo {
+	if len(conf.RelabelConfigs) == 0 {
+		return collections
+	}
+	out := make(map[string]CollectionInfo, len(collections))
+	for key, c := range collections {
+		c.RelabelConfigs = slices.Concat(c.RelabelConfigs, conf.RelabelConfigs)
+		out[key] = c
+	}
+	return out
+}
+
+// resolveScope determines the query scope of a request from the tenant header
+// and the access policy of the authenticated principal.
+func resolveScope(r *http.Request) (*queryScope, error) {
+	scope, err := resolveTenant(r)
+	if err != nil {
+		return nil, err
+	}
+	scope.Matchers = accessPolicies[principalFromContext(r.Context())]
+	return scope, nil
+}
+
+func resolveTenant(r *http.Request) (*queryScope, error) {
+	t := conf.Tenancy
+	if !t.Enabled {
+		return globalScope(), nil
+	}
+	header := t.Header
+	if header == "" {
+		header = defaultTenantHeader
+	}
+	id := r.Header.Get(header)
+	if id == "" {
+		return nil, fmt.Errorf("%w: missing %s header", errNoTenant, header)
+	}
+	if !validTenantID.MatchString(id) {
+		return nil, fmt.Errorf("%w: invalid tenant ID %q", errNoTenant, id)
+	}
+	tc, listed := t.Tenants[id]
+	if !listed && !t.AllowUnlisted {
+		return nil, fmt.Errorf("%w: unknown tenant %q", errTenantDenied, id)
+	}
+	if len(tc.Principals) > 0 && !slices.Contains(tc.Principals, principalFromContext(r.Context())) {
+		return nil, fmt.Errorf("%w: %q may not query tenant %q", errTenantDenied, principalFromContext(r.Context()), id)
+	}
+
+	scope := &queryScope{
+		Tenant:      id,
+		Database:    conf.MongoDB.Database,
+		Collections: withGlobalRelabeling(mergeMaps(conf.Collections, tc.Collections)),
+		Mappings:    mergeMaps(conf.Mappings, tc.Mappings),
+		Limits:      tc.Limits,
+	}
+	switch t.Mode {
+	case "", "database":
+		db, err := tenantDatabase(t, id)
+		if err != nil {
+			return nil, err
+		}
+		scope.Database = db
+	case "field":
+		value := id
+		if tc.FieldValue != "" {
+			value = tc.FieldValue
+		}
+		scope.Fields = map[string]string{t.TenantField: value}
+	}
+	return scope, nil
+}
+
+// tenantDatabase returns the database of a tenant in database mode. Listed
+// tenants use their configured database, or their ID. Unlisted tenants get
+// the database prefix in front of their ID and are denied when that names
+// the database of a listed tenant, the global database or a MongoDB system
+// database, so they cannot reach data they were not given.
+func tenantDatabase(t TenancyConfig, id string) (string, error) {
+	if tc, listed := t.Tenants[id]; listed {
+		if tc.Database != "" {
+			return tc.Database, nil
+		}
+		return id, nil
+	}
+	name := t.DatabasePrefix + id
+	taken := append([]string{conf.MongoDB.Database}, reservedDatabases...)
+	for listed := range t.Tenants {
+		db, _ := tenantDatabase(t, listed)
+		taken = append(taken, db)
+	}
+	for _, db := range taken {
+		// MongoDB does not allow database names that differ only in case.
+		if strings.EqualFold(name, db) {
+			return "", fmt.Errorf("%w: tenant %q would use the reserved database %q", errTenantDenied, id, name)
+		}
+	}
+	return name, nil
+}
+
+// validateTenancy checks the tenancy configuration at startup.
+func validateTenancy(t TenancyConfig) error {
+	if !t.Enabled {
+		return nil
+	}
+	switch t.Mode {
+	case "", "database":
+	case "field":
+		if t.TenantField == "" {
+			return errors.New("tenancy: tenantField is required in field mode")
+		}
+	default:
+		return fmt.Errorf("tenancy: unknown mode %q", t.Mode)
+	}
+	if !validDatabasePrefix.MatchString(t.DatabasePrefix) {
+		return fmt.Errorf("tenancy: invalid databasePrefix %q", t.DatabasePrefix)
+	}
+	for _, id := range sortedKeys(t.Tenants) {
+		if !validTenantID.MatchString(id) {
+			return fmt.Errorf("tenancy: invalid tenant ID %q", id)
+		}
+		if t.Mode == "field" {
+			continue
+		}
+		db, _ := tenantDatabase(t, id)
+		for _, reserved := range reservedDatabases {
+			if strings.EqualFold(db, reserved) {
+				return fmt.Errorf("tenancy: tenant %q uses the MongoDB system database %q", id, db)
+			}
+		}
+	}
+	return nil
+}
+
+// translator returns a translator for the collections and mappings of this
+// scope, applying its mandatory fields and policy matchers to every read.
+func (s *queryScope) translator() *translate.Translator {
+	collections := make(map[string]translate.Collection, len(s.Collections))
+	for key, c := range s.Collections {
+		collections[key] = c.Collection
+	}
+	return &translate.Translator{
+		Database:    s.Database,
+		Collections: collections,
+		Mappings:    mappingKeys(s.Mappings),
+		Fields:      s.Fields,
+		Matchers:    s.Matchers,
+	}
+}
+
+// checkRange enforces the maximum query length of the scope.
+func (s *queryScope) checkRange(startTime, endTime time.Time) error {
+	if s.Limits.MaxQueryLength > 0 && endTime.Sub(startTime) > time.Duration(s.Limits.MaxQueryLength)*time.Second {
+		return fmt.Errorf("%w: query range %s exceeds the limit of %ds", errLimitExceeded, endTime.Sub(startTime), s.Limits.MaxQueryLength)
+	}
+	return nil
+}
+
+// mergeMaps returns base overlaid with override.
+func mergeMaps[V any](base, override map[string]V) map[string]V {
+	if len(override) == 0 {
+		return base
+	}
+	merged := make(map[string]V, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
+
+func withScope(ctx context.Context, s *queryScope) context.Context {
+	return context.WithValue(ctx, ctxKeyScope, s)
+}
+
+// scopeFromContext returns the scope of the current query, defaulting to the global scope.
+func scopeFromContext(ctx context.Context) *queryScope {
+	if s, ok := ctx.Value(ctxKeyScope).(*queryScope); ok {
+		return s
+	}
+	return globalScope()
+}
+
+// sendScopeError reports a failure to resolve the query scope.
+func sendScopeError(w http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	if errors.Is(err, errNoTenant) {
+		status = http.StatusUnauthorized
+	}
+	sendJSONError(w, status, "unauthorized", err.Error())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// runTranslateCommand implements the "translate" subcommand: it prints the
+// MongoDB reads the query endpoint would run for a query, as extended JSON
+// or mongosh statements, without connecting to MongoDB. It exits with 1 and
+// the reason when the query cannot be translated.
+func runTranslateCommand(args []string) int {
+	fs, configFile := commandFlags("translate")
+	query := fs.String("query", "", "PromQL query (required)")
+	start := fs.String("start", "", "Range start, Unix seconds or RFC3339")
+	end := fs.String("end", "", "Range end, Unix seconds or RFC3339")
+	step := fs.String("step", "", "Range step, seconds or a duration such as 1m")
+	format := fs.String("format", "json", "Output format: json (extended JSON) or mongosh")
+	tenant := fs.String("tenant", "", "Tenant ID, when multi-tenancy is enabled")
+	principal := fs.String("principal", "", "Authenticated user or token name whose access policy applies")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *query == "" {
+		fmt.Fprintln(os.Stderr, "translate: -query is required")
+		return 2
+	}
+	if *format != "json" && *format != "mongosh" {
+		fmt.Fprintf(os.Stderr, "translate: unknown format %q\n", *format)
+		return 2
+	}
+	if err := loadConfig(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := loadAccessPolicies(conf.AccessPolicies); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var startTime, endTime time.Time
+	var stepDur time.Duration
+	isRange := *start != "" || *end != "" || *step != ""
+	if isRange {
+		var err error
+		if startTime, err = parseTime(*start); err != nil {
+			fmt.Fprintln(os.Stderr, "translate: invalid -start:", err)
+			return 2
+		}
+		if endTime, err = parseTime(*end); err != nil {
+			fmt.Fprintln(os.Stderr, "translate: invalid -end:", err)
+			return 2
+		}
+		if stepDur, err = parseDuration(*step); err != nil || stepDur <= 0 {
+			fmt.Fprintln(os.Stderr, "translate: -step must be a positive duration")
+			return 2
+		}
+	}
+
+	scope, err := commandScope(*tenant, *principal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "translate:", err)
+		return 1
+	}
+	reads, err := translateQuery(scope, *query, isRange, startTime, endTime, stepDur)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "translate:", err)
+		return 1
+	}
+	if err := printReads(os.Stdout, scope.Database, reads, *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// commandScope resolves the query scope a request from the given tenant and
+// principal would get.
+func commandScope(tenant, principal string) (*queryScope, error) {
+	r, err := http.NewRequest(http.MethodGet, "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	if tenant != "" {
+		header := conf.Tenancy.Header
+		if header == "" {
+			header = defaultTenantHeader
+		}
+		r.Header.Set(header, tenant)
+	}
+	if principal != "" {
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyPrincipal, principal))
+	}
+	return resolveScope(r)
+}
+
+// translateQuery returns the reads handleQuery runs for a query, or an error
+// wrapping translate.ErrUnsupported with the reason.
+func translateQuery(scope *queryScope, query string, isRange bool, start, end time.Time, step time.Duration) ([]translate.Read, error) {
+	if isRange {
+		// The time range is half-open; one millisecond past end includes it.
+		end = end.Add(time.Millisecond)
+	}
+	plan, err := scope.translator().Translate(query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Reads) > 1 {
+		return nil, fmt.Errorf("%w: the selector matches metrics in several collections", translate.ErrUnsupported)
+	}
+	return queryPlan(scope, plan.Reads[0], scope.Collections[plan.Reads[0].Key], isRange, step), nil
+}
+
+// printReads writes the reads as extended JSON documents or mongosh
+// statements. The matchers the bridge checks on the documents returned,
+// because the filter cannot decide them exactly, are listed with each read.
+func printReads(w io.Writer, database string, reads []translate.Read, format string) error {
+	for _, read := range reads {
+		var residual []string
+		for _, m := range read.Residual() {
+			residual = append(residual, m.String())
+		}
+		relabeled := len(read.Collection.RelabelConfigs) > 0
+		if format == "mongosh" {
+			fmt.Fprintf(w, "db.getSiblingDB(%s).getCollection(%s).find(%s)\n",
+				strconv.Quote(database), strconv.Quote(read.Collection.Name), mongoshValue(translate.Filter(read)))
+			if len(residual) > 0 {
+				fmt.Fprintf(w, "// then matched by the bridge: {%s}\n", strings.Join(residual, ", "))
+			}
+			if relabeled {
+				fmt.Fprintln(w, "// series are relabeled by the bridge")
+			}
+			continue
+		}
+		filter, err := bson.MarshalExtJSON(translate.Filter(read), false, false)
+		if err != nil {
+			return err
+		}
+		doc := map[string]interface{}{
+			"database":   database,
+			"collection": read.Collection.Name,
+			"filter":     json.RawMessage(filter),
+		}
+		if len(residual) > 0 {
+			doc["residualMatchers"] = residual
+		}
+		if relabeled {
+			doc["relabeled"] = true
+		}
+		out, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(out))
+	}
+	return nil
+}
+
+var jsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// mongoshValue renders a filter value in mongosh syntax, with keys sorted.
+func mongoshValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(t)
+	case bool:
+		return strconv.FormatBool(t)
+	case int, int32, int64:
+		return fmt.Sprintf("%d", t)
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case time.Time:
+		return fmt.Sprintf("ISODate(%q)", t.UTC().Format(time.RFC3339Nano))
+	case primitive.Regex:
+		return "/" + strings.ReplaceAll(t.Pattern, "/", `\/`) + "/" + t.Options
+	case []interface{}:
+		parts := make([]string, len(t))
+		for i, item := range t {
+			parts[i] = mongoshValue(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]interface{}:
+		parts := make([]string, 0, len(t))
+		for _, k := range sortedKeys(t) {
+			key := k
+			if !jsIdentifier.MatchString(k) {
+				key = strconv.Quote(k)
+			}
+			parts = append(parts, key+": "+mongoshValue(t[k]))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case bson.M:
+		return mongoshValue(map[string]interface{}(t))
+	}
+	return fmt.Sprintf("%v", v)
+}
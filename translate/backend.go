@@ -0,0 +1,135 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Cursor iterates over the documents of a read. *mongo.Cursor implements it.
+type Cursor interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// Backend is a document store: it runs reads and takes new documents.
+type Backend interface {
+	// Find returns the documents selected by a read.
+	Find(ctx context.Context, read Read) (Cursor, error)
+	// Distinct returns the distinct values of a field among the documents
+	// selected by a read.
+	Distinct(ctx context.Context, read Read, field string) ([]interface{}, error)
+	// Insert adds documents to a collection.
+	Insert(ctx context.Context, database, collection string, docs ...Document) error
+	// Upsert adds documents to a collection unless a document equal in all
+	// fields but valueField exists, whose value it then replaces.
+	Upsert(ctx context.Context, database, collection, valueField string, docs ...Document) error
+}
+
+// Series is a labelled series of float samples.
+type Series struct {
+	Labels  labels.Labels
+	Samples []Sample
+}
+
+// Sample is a value at a timestamp in milliseconds.
+type Sample struct {
+	T int64
+	F float64
+}
+
+// Run executes a plan and returns the series read, sorted by labels, with
+// samples sorted by time. Documents that cannot be decoded are skipped.
+func Run(ctx context.Context, b Backend, plan *Plan) ([]Series, error) {
+	bySignature := map[string]*Series{}
+	for _, read := range plan.Reads {
+		cursor, err := b.Find(ctx, read)
+		if err != nil {
+			return nil, err
+		}
+		for cursor.Next(ctx) {
+			var doc Document
+			if err := cursor.Decode(&doc); err != nil {
+				continue
+			}
+			ts, v, metricLabels, err := read.Collection.ExtractSample(doc)
+			if err != nil {
+				continue
+			}
+			lset := labels.FromMap(metricLabels)
+			if !matchesAll(lset, read.Matchers) {
+				continue
+			}
+			sig := lset.String()
+			s, ok := bySignature[sig]
+			if !ok {
+				s = &Series{Labels: lset}
+				bySignature[sig] = s
+			}
+			s.Samples = append(s.Samples, Sample{T: int64(math.Round(ts * 1000)), F: v})
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cursor error: %w", err)
+		}
+	}
+
+	out := make([]Series, 0, len(bySignature))
+	for _, s := range bySignature {
+		sort.SliceStable(s.Samples, func(i, j int) bool { return s.Samples[i].T < s.Samples[j].T })
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return labels.Compare(out[i].Labels, out[j].Labels) < 0 })
+	return out, nil
+}
+
+func matchesAll(lset labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// residualCursor skips the documents that do not match the residual
+// matchers of a read.
+type residualCursor struct {
+	Cursor
+	coll     Collection
+	matchers []*labels.Matcher
+}
+
+func (c *residualCursor) Next(ctx context.Context) bool {
+	for c.Cursor.Next(ctx) {
+		var doc Document
+		if err := c.Cursor.Decode(&doc); err != nil {
+			return true // the caller sees the error on Decode
+		}
+		if matchesResidual(c.coll, doc, c.matchers) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesResidual checks matchers on the labels of the series a document
+// belongs to. Documents whose labels cannot be extracted are left to the
+// caller, except for series dropped by relabeling.
+func matchesResidual(coll Collection, doc Document, matchers []*labels.Matcher) bool {
+	if len(matchers) == 0 {
+		return true
+	}
+	_, _, lbls, err := coll.ExtractSample(doc)
+	if err != nil {
+		return !errors.Is(err, ErrDropped)
+	}
+	return matchesAll(labels.FromMap(lbls), matchers)
+}
@@ -0,0 +1,283 @@
+package translate
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	promvalue "github.com/prometheus/prometheus/model/value"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Document is a stored document as decoded by the MongoDB driver.
+type Document = map[string]interface{}
+
+// Collection describes how the documents of one collection map to samples.
+type Collection struct {
+	Name        string            `yaml:"name"`
+	TimeField   string            `yaml:"timeField"`
+	MetricField string            `yaml:"metricField"` // Field for __name__ label
+	ValueField  string            `yaml:"valueField"`  // Field for the numeric value
+	LabelFields map[string]string `yaml:"labelFields"`
+	DefaultLbls map[string]string `yaml:"defaultLabels"`
+	LabelsField string            `yaml:"labelsField"` // Optional subdocument holding labels without a labelFields entry
+
+	ValueTransform ValueTransform `yaml:"valueTransform"` // Conversion of stored values, e.g. from milliseconds
+	DerivedLabels  []DerivedLabel `yaml:"derivedLabels"`  // Labels computed from document fields
+
+	RelabelConfigs []*relabel.Config `yaml:"relabelConfigs"` // Applied to the labels of each series read
+}
+
+// Validate checks the value transform, derived labels and relabel configs.
+func (c Collection) Validate() error {
+	if err := c.ValueTransform.validate(); err != nil {
+		return fmt.Errorf("valueTransform: %w", err)
+	}
+	for _, d := range c.DerivedLabels {
+		if err := d.validate(); err != nil {
+			return err
+		}
+	}
+	for i, cfg := range c.RelabelConfigs {
+		if cfg == nil {
+			return fmt.Errorf("relabelConfigs[%d] is empty", i)
+		}
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("relabelConfigs[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// DerivedLabel returns the derivation of a label, if it is derived.
+func (c Collection) DerivedLabel(name string) (DerivedLabel, bool) {
+	for _, d := range c.DerivedLabels {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return DerivedLabel{}, false
+}
+
+// LabelField returns the document field (a dotted path for labels kept in
+// the labels subdocument) holding a label. Labels without a field only ever
+// have their default value. Derived labels are not held in a field.
+func (c Collection) LabelField(name string) (string, bool) {
+	field, mapped := c.LabelFields[name]
+	if _, derived := c.DerivedLabel(name); derived {
+		return "", false
+	}
+	switch {
+	case name == model.MetricNameLabel && c.MetricField != "":
+		return c.MetricField, true
+	case !mapped && c.LabelsField != "" && name != model.MetricNameLabel:
+		return c.LabelsField + "." + name, true
+	}
+	return field, mapped
+}
+
+// Extract returns the timestamp in seconds, the value formatted as by
+// FormatValue and the labels of a document. Documents without a readable
+// value, or holding a staleness marker, are an error.
+func (c Collection) Extract(doc Document) (float64, string, map[string]string, error) {
+	timestamp, value, metricLabels, err := c.ExtractSample(doc)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if promvalue.IsStaleNaN(value) {
+		return 0, "", nil, fmt.Errorf("value field %q holds a staleness marker", c.ValueField)
+	}
+	return timestamp, FormatValue(value), metricLabels, nil
+}
+
+// ExtractSample is Extract with the value as a float. Fields may be dotted
+// paths into embedded documents. The collection's value
+// transform is applied, except to a stored staleness marker, which keeps its
+// bit pattern. Series that relabeling drops return ErrDropped.
+func (c Collection) ExtractSample(doc Document) (float64, float64, map[string]string, error) {
+	// Extract timestamp
+	var timestamp float64
+	if timeVal, ok := Lookup(doc, c.TimeField); ok {
+		if t, ok := timeValue(timeVal); ok {
+			timestamp = float64(t.UnixNano()) / 1e9
+		} else {
+			switch tv := timeVal.(type) {
+			case float64:
+				timestamp = tv // Assume it's already Unix seconds
+			case int64:
+				timestamp = float64(tv) // Assume it's Unix seconds
+			case int32:
+				timestamp = float64(tv) // Assume it's Unix seconds
+			case string:
+				slog.Warn("Could not parse time string, using current time", "value", tv)
+				timestamp = float64(time.Now().UnixNano()) / 1e9
+			default:
+				slog.Warn("Unhandled time type, using current time", "type", fmt.Sprintf("%T", tv), "field", c.TimeField)
+				timestamp = float64(time.Now().UnixNano()) / 1e9
+			}
+		}
+	} else {
+		slog.Warn("Time field not found, using current time", "field", c.TimeField)
+		timestamp = float64(time.Now().UnixNano()) / 1e9
+	}
+
+	// Extract numeric metric value from ValueField
+	val, ok := Lookup(doc, c.ValueField)
+	if !ok || val == nil {
+		return 0, 0, nil, fmt.Errorf("value field %q not found", c.ValueField)
+	}
+	value, ok := Value(val)
+	if !ok {
+		return 0, 0, nil, fmt.Errorf("value field %q holds no number: %v (%T)", c.ValueField, val, val)
+	}
+	if !promvalue.IsStaleNaN(value) {
+		value = c.ValueTransform.Apply(value)
+	}
+
+	// Build metric labels
+	metricLabels := make(map[string]string)
+	// Add default labels first
+	for k, v := range c.DefaultLbls {
+		metricLabels[k] = v
+	}
+	// Add labels kept in the labels subdocument, if the collection has one
+	if c.LabelsField != "" {
+		sub, _ := Lookup(doc, c.LabelsField)
+		for k, v := range Subdocument(sub) {
+			metricLabels[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	// Add labels from the document, potentially overwriting defaults
+	for promLabel, mongoField := range c.LabelFields {
+		if val, ok := Lookup(doc, mongoField); ok {
+			metricLabels[promLabel] = fmt.Sprintf("%v", val) // Convert label value to string
+		}
+	}
+
+	// Add __name__ label based on the MetricField value
+	if nameVal, ok := Lookup(doc, c.MetricField); ok {
+		metricLabels[model.MetricNameLabel] = fmt.Sprintf("%v", nameVal)
+	} else if _, ok := metricLabels[model.MetricNameLabel]; !ok {
+		slog.Warn("MetricField not found and no default __name__ label set", "field", c.MetricField)
+	}
+
+	// Derived labels replace whatever was stored under their name
+	for _, d := range c.DerivedLabels {
+		if v := d.Value(doc); v != "" {
+			metricLabels[d.Name] = v
+		} else {
+			delete(metricLabels, d.Name)
+		}
+	}
+
+	metricLabels, err := c.relabelSeries(metricLabels)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return timestamp, value, metricLabels, nil
+}
+
+// Value converts a stored sample value to a float. Numbers, Decimal128,
+// booleans (1 and 0) and numeric strings are understood, including "NaN",
+// "+Inf" and "-Inf".
+func Value(v interface{}) (float64, bool) {
+	switch tv := v.(type) {
+	case float64:
+		return tv, true
+	case float32:
+		return float64(tv), true
+	case int:
+		return float64(tv), true
+	case int32:
+		return float64(tv), true
+	case int64:
+		return float64(tv), true
+	case bool:
+		if tv {
+			return 1, true
+		}
+		return 0, true
+	case primitive.Decimal128:
+		// String gives "NaN", "Infinity" and "-Infinity" for the special values.
+		f, err := strconv.ParseFloat(tv.String(), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(tv), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// FormatValue formats a sample value as the Prometheus API does.
+func FormatValue(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// timeValue converts the date representations of a time field.
+func timeValue(v interface{}) (time.Time, bool) {
+	switch tv := v.(type) {
+	case time.Time:
+		return tv, true
+	case primitive.DateTime:
+		// BSON dates decode to primitive.DateTime inside generic maps
+		return tv.Time(), true
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, tv); err == nil {
+			return t, true
+		}
+		if t, err := time.Parse(time.RFC3339, tv); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Subdocument returns an embedded document as a map, whichever form the driver decoded it into.
+func Subdocument(v interface{}) map[string]interface{} {
+	switch d := v.(type) {
+	case map[string]interface{}:
+		return d
+	case primitive.M:
+		return d
+	case primitive.D:
+		return d.Map()
+	}
+	return nil
+}
+
+// Lookup returns the value of a possibly dotted field path in a document.
+func Lookup(doc Document, path string) (interface{}, bool) {
+	for {
+		head, rest, nested := strings.Cut(path, ".")
+		v, ok := doc[head]
+		if !ok || !nested {
+			return v, ok
+		}
+		if doc = Subdocument(v); doc == nil {
+			return nil, false
+		}
+		path = rest
+	}
+}
+
+// Set stores a value under a possibly dotted field path, creating the
+// embedded documents on the way.
+func Set(doc Document, path string, v interface{}) {
+	for {
+		head, rest, nested := strings.Cut(path, ".")
+		if !nested {
+			doc[head] = v
+			return
+		}
+		sub := Subdocument(doc[head])
+		if sub == nil {
+			sub = Document{}
+			doc[head] = sub
+		}
+		doc, path = sub, rest
+	}
+}
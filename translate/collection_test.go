@@ -0,0 +1,122 @@
+package translate
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/model/value"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExtractValue(t *testing.T) {
+	decimal := func(s string) primitive.Decimal128 {
+		d, err := primitive.ParseDecimal128(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for _, tc := range []struct {
+		stored interface{}
+		want   string // "" for documents that are dropped
+	}{
+		{stored: 1.5, want: "1.5"},
+		{stored: int32(7), want: "7"},
+		{stored: int64(1) << 53, want: "9007199254740992"},
+		{stored: 1e21, want: "1000000000000000000000"},
+		{stored: true, want: "1"},
+		{stored: false, want: "0"},
+		{stored: decimal("19.99"), want: "19.99"},
+		{stored: decimal("-1.5E+3"), want: "-1500"},
+		{stored: decimal("NaN"), want: "NaN"},
+		{stored: decimal("-Infinity"), want: "-Inf"},
+		{stored: "42", want: "42"},
+		{stored: "NaN", want: "NaN"},
+		{stored: "+Inf", want: "+Inf"},
+		{stored: "-Inf", want: "-Inf"},
+		{stored: math.Inf(1), want: "+Inf"},
+		{stored: "n/a"},
+		{stored: nil},
+		{stored: primitive.ObjectID{}},
+		{stored: math.Float64frombits(value.StaleNaN)},
+	} {
+		doc := Document{"ts": time.Unix(10, 0), "name": "up", "value": tc.stored}
+		_, got, _, err := testCollection.Extract(doc)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%v (%T): got %q, want the document dropped", tc.stored, tc.stored, got)
+		case tc.want != "" && (err != nil || got != tc.want):
+			t.Errorf("%v (%T): got %q, %v, want %q", tc.stored, tc.stored, got, err, tc.want)
+		}
+	}
+
+	if _, _, _, err := testCollection.Extract(Document{"ts": time.Unix(10, 0), "name": "up"}); err == nil {
+		t.Error("a document without a value is not dropped")
+	}
+	_, v, _, err := testCollection.ExtractSample(Document{"ts": time.Unix(10, 0), "name": "up", "value": math.Float64frombits(value.StaleNaN)})
+	if err != nil || !value.IsStaleNaN(v) {
+		t.Errorf("ExtractSample lost a staleness marker: %v, %v", v, err)
+	}
+}
+
+func TestValueTransform(t *testing.T) {
+	negate, fahrenheit, zero := -1.0, 9.0/5, 0.0
+	for _, tc := range []struct {
+		transform ValueTransform
+		stored    float64
+		want      float64
+	}{
+		{transform: ValueTransform{Unit: "ms"}, stored: 250, want: 0.25},
+		{transform: ValueTransform{Unit: "KiB"}, stored: 2, want: 2048},
+		{transform: ValueTransform{Unit: "percent"}, stored: 42, want: 0.42},
+		{transform: ValueTransform{Scale: &negate, Offset: 1}, stored: 1, want: 0},
+		{transform: ValueTransform{Unit: "ms", Invert: true}, stored: 500, want: 2},
+		{transform: ValueTransform{Unit: "h"}, stored: 2, want: 7200},
+		{transform: ValueTransform{Scale: &fahrenheit, Offset: 32}, stored: 100, want: 212},
+	} {
+		c := testCollection
+		c.ValueTransform = tc.transform
+		_, got, _, err := c.ExtractSample(Document{"ts": time.Unix(10, 0), "name": "up", "value": tc.stored})
+		if err != nil || math.Abs(got-tc.want) > 1e-12 {
+			t.Errorf("%+v of %v: got %v, %v, want %v", tc.transform, tc.stored, got, err, tc.want)
+		}
+		if back := tc.transform.Reverse(got); math.Abs(back-tc.stored) > 1e-9 {
+			t.Errorf("%+v: Reverse(%v) = %v, want %v", tc.transform, got, back, tc.stored)
+		}
+	}
+	if err := (Collection{ValueTransform: ValueTransform{Unit: "furlongs"}}).Validate(); err == nil {
+		t.Error("an unknown unit is accepted")
+	}
+	if err := (Collection{ValueTransform: ValueTransform{Scale: &zero}}).Validate(); err == nil {
+		t.Error("scale 0 is accepted")
+	}
+}
+
+func TestDerivedLabels(t *testing.T) {
+	sep, repl := ":", "$2"
+	c := testCollection
+	c.DerivedLabels = []DerivedLabel{
+		{Name: "instance", Template: "${host}:${port}"},
+		{Name: "zone", SourceFields: []string{"labels.region", "host"}, Separator: &sep, Regex: relabel.MustNewRegexp(`(\w+)-(\w+):.*`), Replacement: &repl},
+		{Name: "domain", SourceFields: []string{"host"}, Regex: relabel.MustNewRegexp(`[^.]+\.(.+)`)},
+	}
+	_, _, lbls, err := c.Extract(Document{
+		"ts": time.Unix(10, 0), "name": "up", "value": 1.0,
+		"host": "web1.example.com", "port": int32(8080), "labels": Document{"region": "eu-west", "domain": "stored"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"__name__": "up", "instance": "web1.example.com:8080", "region": "eu-west", "zone": "west", "domain": "example.com"}
+	if !reflect.DeepEqual(lbls, want) {
+		t.Errorf("got labels %v, want %v", lbls, want)
+	}
+
+	_, _, lbls, _ = c.Extract(Document{"ts": time.Unix(10, 0), "name": "up", "value": 1.0, "host": "localhost", "labels": Document{"domain": "stored"}})
+	if _, ok := lbls["domain"]; ok {
+		t.Errorf("a derived label whose regex does not match is set: %v", lbls)
+	}
+}
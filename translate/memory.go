@@ -0,0 +1,226 @@
+package translate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Memory is an in-memory document store, for tests and for embedding the
+// bridge without a database. Reads select documents as MongoDB would for
+// the filter of the read.
+type Memory struct {
+	mu  sync.RWMutex
+	dbs map[string]map[string][]Document // database -> collection name -> documents
+}
+
+// NewMemory returns an empty store.
+func NewMemory() *Memory {
+	return &Memory{dbs: map[string]map[string][]Document{}}
+}
+
+// Insert adds documents to a collection. Documents are stored as MongoDB
+// would return them, so time.Time values read back as BSON dates.
+func (m *Memory) Insert(_ context.Context, database, collection string, docs ...Document) error {
+	normalized := make([]Document, 0, len(docs))
+	for _, doc := range docs {
+		var d Document
+		if err := roundTrip(doc, &d); err != nil {
+			return err
+		}
+		normalized = append(normalized, d)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dbs[database] == nil {
+		m.dbs[database] = map[string][]Document{}
+	}
+	m.dbs[database][collection] = append(m.dbs[database][collection], normalized...)
+	return nil
+}
+
+// Upsert adds documents to a collection, or replaces the value of stored
+// documents equal in all other fields.
+func (m *Memory) Upsert(_ context.Context, database, collection, valueField string, docs ...Document) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dbs[database] == nil {
+		m.dbs[database] = map[string][]Document{}
+	}
+	stored := m.dbs[database][collection]
+	index := make(map[string]int, len(stored))
+	for i, doc := range stored {
+		index[upsertKey(doc, valueField)] = i
+	}
+	for _, doc := range docs {
+		var d Document
+		if err := roundTrip(doc, &d); err != nil {
+			return err
+		}
+		key := upsertKey(d, valueField)
+		if i, ok := index[key]; ok {
+			value, _ := Lookup(d, valueField)
+			Set(stored[i], valueField, value)
+			continue
+		}
+		index[key] = len(stored)
+		stored = append(stored, d)
+	}
+	m.dbs[database][collection] = stored
+	return nil
+}
+
+// upsertKey identifies a document by all fields but valueField, a possibly
+// dotted path, regardless of the order of fields in subdocuments.
+func upsertKey(doc Document, valueField string) string {
+	var canonical func(v interface{}) interface{}
+	canonical = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case bson.D:
+			m := make(map[string]interface{}, len(t))
+			for _, e := range t {
+				m[e.Key] = canonical(e.Value)
+			}
+			return m
+		case map[string]interface{}:
+			m := make(map[string]interface{}, len(t))
+			for k, e := range t {
+				m[k] = canonical(e)
+			}
+			return m
+		case bson.M:
+			return canonical(map[string]interface{}(t))
+		}
+		return v
+	}
+	key := canonical(doc).(map[string]interface{})
+	for parent, path := key, valueField; ; {
+		head, rest, nested := strings.Cut(path, ".")
+		if !nested {
+			delete(parent, head)
+			break
+		}
+		if parent, _ = parent[head].(map[string]interface{}); parent == nil {
+			break
+		}
+		path = rest
+	}
+	return fmt.Sprint(key)
+}
+
+func (m *Memory) Find(_ context.Context, read Read) (Cursor, error) {
+	return &sliceCursor{docs: m.selectDocs(read), i: -1}, nil
+}
+
+func (m *Memory) Distinct(_ context.Context, read Read, field string) ([]interface{}, error) {
+	var out []interface{}
+	seen := map[string]bool{}
+	for _, doc := range m.selectDocs(read) {
+		v, ok := Lookup(doc, field)
+		key := fmt.Sprintf("%T:%v", v, v)
+		if ok && v != nil && !seen[key] {
+			seen[key] = true
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
+
+// selectDocs returns the documents of a read's collection matching its
+// fields, time range and matchers, in insertion order.
+func (m *Memory) selectDocs(read Read) []Document {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []Document
+	for _, doc := range m.dbs[read.Database][read.Collection.Name] {
+		if matchesRead(read, doc) {
+			out = append(out, doc)
+		}
+	}
+	return out
+}
+
+func matchesRead(read Read, doc Document) bool {
+	for field, value := range read.Fields {
+		if v, ok := Lookup(doc, field); !ok || v != value {
+			return false
+		}
+	}
+	if !read.Start.IsZero() || !read.End.IsZero() {
+		// Range operators on a date only match BSON dates.
+		v, _ := Lookup(doc, read.Collection.TimeField)
+		if !isDate(v) {
+			return false
+		}
+		t, _ := timeValue(v)
+		if (!read.Start.IsZero() && t.Before(read.Start)) || (!read.End.IsZero() && !t.Before(read.End)) {
+			return false
+		}
+	}
+	pushed, _, ok := read.Collection.pushdown(read.Matchers)
+	if !ok {
+		return false
+	}
+	for _, matcher := range pushed {
+		if !matchesField(read.Collection, doc, matcher) {
+			return false
+		}
+	}
+	return matchesResidual(read.Collection, doc, read.Residual())
+}
+
+// matchesField evaluates a matcher like its MongoDB filter: a missing or
+// null field has the default value, and values that are not strings match the
+// negative matchers only. Derived labels are computed, as MongoDB reads
+// check them on the documents returned.
+func matchesField(coll Collection, doc Document, m *labels.Matcher) bool {
+	field, mapped := coll.LabelField(m.Name)
+	def := coll.DefaultLbls[m.Name]
+	if d, derived := coll.DerivedLabel(m.Name); derived {
+		if field, mapped = d.copiedField(); !mapped {
+			return m.Matches(d.Value(doc))
+		}
+		def = ""
+	}
+	if !mapped {
+		return m.Matches(def)
+	}
+	v, _ := Lookup(doc, field)
+	switch s := v.(type) {
+	case nil:
+		return m.Matches(def)
+	case string:
+		return m.Matches(s)
+	}
+	return m.Type == labels.MatchNotEqual || m.Type == labels.MatchNotRegexp
+}
+
+func isDate(v interface{}) bool {
+	_, isTime := timeValue(v)
+	_, isString := v.(string)
+	return isTime && !isString
+}
+
+// roundTrip converts a value through BSON, as storing and reading it would.
+func roundTrip(in, out interface{}) error {
+	raw, err := bson.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("encoding document: %w", err)
+	}
+	return bson.Unmarshal(raw, out)
+}
+
+// sliceCursor iterates over documents held in memory.
+type sliceCursor struct {
+	docs []Document
+	i    int
+}
+
+func (c *sliceCursor) Next(context.Context) bool    { c.i++; return c.i < len(c.docs) }
+func (c *sliceCursor) Decode(val interface{}) error { return roundTrip(c.docs[c.i], val) }
+func (c *sliceCursor) Err() error                   { return nil }
+func (c *sliceCursor) Close(context.Context) error  { return nil }
@@ -0,0 +1,283 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+var testCollection = Collection{
+	Name:        "metrics",
+	TimeField:   "ts",
+	MetricField: "name",
+	ValueField:  "value",
+	LabelFields: map[string]string{"job": "job"},
+	LabelsField: "labels",
+}
+
+func TestMemorySelects(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	err := m.Insert(context.Background(), "db", "metrics",
+		Document{"ts": t0, "name": "up", "value": 1.0, "job": "api", "labels": Document{"zone": "a"}},
+		Document{"ts": t0.Add(time.Minute), "name": "up", "value": 1.0, "job": "web"},
+		Document{"ts": t0.Add(2 * time.Minute), "name": "up", "value": 0.0, "job": 7},
+		Document{"ts": t0.Format(time.RFC3339), "name": "up", "value": 1.0, "job": "api"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		matchers   []*labels.Matcher
+		start, end time.Time
+		want       int
+	}{
+		{name: "all", want: 4},
+		{name: "equal", matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "api")}, want: 2},
+		{name: "not equal matches other types", matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "job", "api")}, want: 2},
+		{name: "regexp is anchored", matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "job", "ap")}, want: 0},
+		{name: "missing label is empty", matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "zone", "")}, want: 3},
+		{name: "labels subdocument", matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "zone", "a")}, want: 1},
+		{name: "half-open range of dates", start: t0, end: t0.Add(2 * time.Minute), want: 2},
+		{name: "open end", start: t0.Add(time.Minute), want: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			read := Read{Database: "db", Collection: testCollection, Matchers: tc.matchers, Start: tc.start, End: tc.end}
+			cursor, err := m.Find(context.Background(), read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := 0
+			for cursor.Next(context.Background()) {
+				var doc Document
+				if err := cursor.Decode(&doc); err != nil {
+					t.Fatal(err)
+				}
+				got++
+			}
+			if got != tc.want {
+				t.Errorf("got %d documents, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranslateUnsupported(t *testing.T) {
+	tr := &Translator{
+		Database:    "db",
+		Collections: map[string]Collection{"metrics": testCollection},
+		Mappings:    map[string]string{"up": "metrics"},
+	}
+	for _, query := range []string{`rate(up[5m])`, `up offset 5m`, `missing`} {
+		if _, err := tr.Translate(query, time.Time{}, time.Time{}); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Translate(%q): got %v, want ErrUnsupported", query, err)
+		}
+	}
+	plan, err := tr.Translate(`up{job="api"}[5m]`, time.Time{}, time.Time{})
+	if err != nil || len(plan.Reads) != 1 || plan.Reads[0].Key != "metrics" {
+		t.Errorf("Translate: got %+v, %v", plan, err)
+	}
+}
+
+func TestDerivedLabelMatchers(t *testing.T) {
+	coll := testCollection
+	coll.DerivedLabels = []DerivedLabel{
+		{Name: "host", SourceFields: []string{"hostname"}},
+		{Name: "domain", SourceFields: []string{"hostname"}, Regex: relabel.MustNewRegexp(`[^.]+\.(.+)`)},
+		{Name: "instance", Template: "${hostname}:${port}"},
+	}
+	m := NewMemory()
+	err := m.Insert(context.Background(), "db", "metrics",
+		Document{"name": "up", "value": 1.0, "hostname": "web1.example.com", "port": "80"},
+		Document{"name": "up", "value": 1.0, "hostname": "web2.example.org", "port": "80"},
+		Document{"name": "up", "value": 1.0, "hostname": "localhost", "port": "9090"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		matcher  *labels.Matcher
+		filter   string
+		residual bool
+		want     int
+	}{
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "host", "localhost"), filter: "map[hostname:localhost]", want: 1},
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "domain", "example.com"), filter: `map[hostname:{"pattern": "^(?:[^.]+\.(.+))$", "options": "s"}]`, residual: true, want: 1},
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "domain", ""), filter: "map[]", residual: true, want: 1},
+		{matcher: labels.MustNewMatcher(labels.MatchRegexp, "instance", ".*:80"), filter: "map[]", residual: true, want: 2},
+	} {
+		read := Read{Database: "db", Collection: coll, Matchers: []*labels.Matcher{tc.matcher}}
+		if got := fmt.Sprint(Filter(read)); got != tc.filter {
+			t.Errorf("%s: filter %s, want %s", tc.matcher, got, tc.filter)
+		}
+		if got := len(read.Residual()) > 0; got != tc.residual {
+			t.Errorf("%s: residual %v, want %v", tc.matcher, got, tc.residual)
+		}
+		cursor, _ := m.Find(context.Background(), read)
+		got := 0
+		for cursor.Next(context.Background()) {
+			got++
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %d documents, want %d", tc.matcher, got, tc.want)
+		}
+	}
+}
+
+func TestDefaultLabelMatchers(t *testing.T) {
+	coll := testCollection
+	coll.DefaultLbls = map[string]string{"environment": "production"}
+	m := NewMemory()
+	err := m.Insert(context.Background(), "db", "metrics",
+		Document{"name": "up", "value": 1.0},
+		Document{"name": "up", "value": 1.0, "labels": Document{"zone": "a"}},
+		Document{"name": "up", "value": 1.0, "labels": Document{"environment": "staging"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		matcher *labels.Matcher
+		filter  string
+		want    int
+	}{
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "environment", "production"), filter: "map[labels.environment:map[$in:[production <nil>]]]", want: 2},
+		{matcher: labels.MustNewMatcher(labels.MatchNotEqual, "environment", "production"), filter: "map[labels.environment:map[$nin:[production <nil>]]]", want: 1},
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "environment", "staging"), filter: "map[labels.environment:staging]", want: 1},
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "environment", ""), filter: "map[labels.environment:]", want: 0},
+		{matcher: labels.MustNewMatcher(labels.MatchRegexp, "environment", "prod.*"), filter: `map[$or:[map[labels.environment:{"pattern": "^(?:prod.*)$", "options": ""}] map[labels.environment:map[$in:[production <nil>]]]]]`, want: 2},
+		{matcher: labels.MustNewMatcher(labels.MatchNotRegexp, "environment", "stag.*"), filter: `map[labels.environment:map[$not:{"pattern": "^(?:stag.*)$", "options": ""}]]`, want: 2},
+	} {
+		read := Read{Database: "db", Collection: coll, Matchers: []*labels.Matcher{tc.matcher}}
+		if got := fmt.Sprint(Filter(read)); got != tc.filter {
+			t.Errorf("%s: filter %s, want %s", tc.matcher, got, tc.filter)
+		}
+		cursor, _ := m.Find(context.Background(), read)
+		got := 0
+		for cursor.Next(context.Background()) {
+			var doc Document
+			if err := cursor.Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, lbls, err := coll.ExtractSample(doc); err != nil || !tc.matcher.Matches(lbls["environment"]) {
+				t.Errorf("%s: returned series %v, %v", tc.matcher, lbls, err)
+			}
+			got++
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %d documents, want %d", tc.matcher, got, tc.want)
+		}
+	}
+}
+
+func TestRelabelMatchers(t *testing.T) {
+	relabelConfig := func(action relabel.Action, source, target, regex string) *relabel.Config {
+		cfg := relabel.DefaultRelabelConfig
+		cfg.Action, cfg.TargetLabel, cfg.Regex = action, target, relabel.MustNewRegexp(regex)
+		if source != "" {
+			cfg.SourceLabels = []model.LabelName{model.LabelName(source)}
+		}
+		return &cfg
+	}
+	coll := testCollection
+	coll.RelabelConfigs = []*relabel.Config{
+		relabelConfig(relabel.Replace, "job", "service", "(.*)"),
+		relabelConfig(relabel.LabelDrop, "", "", "job"),
+		relabelConfig(relabel.Drop, "service", "", "batch"),
+		relabelConfig(relabel.HashMod, "zone", "shard", ""),
+	}
+	coll.RelabelConfigs[3].Modulus = 2
+	m := NewMemory()
+	err := m.Insert(context.Background(), "db", "metrics",
+		Document{"ts": time.Unix(10, 0), "name": "up", "value": 1.0, "job": "api", "labels": Document{"zone": "a"}},
+		Document{"ts": time.Unix(10, 0), "name": "up", "value": 1.0, "job": "web", "labels": Document{"zone": "b"}},
+		Document{"ts": time.Unix(10, 0), "name": "up", "value": 1.0, "job": "batch"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		matcher  *labels.Matcher
+		filter   string
+		residual bool
+		want     int
+	}{
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "service", "api"), filter: `map[$and:[map[job:api] map[job:map[$not:{"pattern": "^(?:batch)$", "options": ""}]]]]`, want: 1},
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "job", "api"), filter: "map[_id:map[$exists:false]]", want: 0},
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "job", ""), filter: `map[job:map[$not:{"pattern": "^(?:batch)$", "options": ""}]]`, want: 2},
+		{matcher: labels.MustNewMatcher(labels.MatchEqual, "shard", "1"), filter: `map[job:map[$not:{"pattern": "^(?:batch)$", "options": ""}]]`, residual: true},
+	} {
+		read := Read{Database: "db", Collection: coll, Matchers: []*labels.Matcher{tc.matcher}}
+		if got := fmt.Sprint(Filter(read)); got != tc.filter {
+			t.Errorf("%s: filter %s, want %s", tc.matcher, got, tc.filter)
+		}
+		if got := len(read.Residual()) > 0; got != tc.residual {
+			t.Errorf("%s: residual %v, want %v", tc.matcher, got, tc.residual)
+		}
+		if tc.residual {
+			continue
+		}
+		cursor, _ := m.Find(context.Background(), read)
+		got := 0
+		for cursor.Next(context.Background()) {
+			got++
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %d documents, want %d", tc.matcher, got, tc.want)
+		}
+	}
+
+	if _, _, _, err := coll.Extract(Document{"ts": time.Unix(10, 0), "name": "up", "value": 1.0, "job": "batch"}); !errors.Is(err, ErrDropped) {
+		t.Errorf("a dropped series extracts with %v", err)
+	}
+}
+
+func TestMemoryUpsert(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, v := range []float64{1, 2} {
+		err := m.Upsert(ctx, "db", "metrics", "value",
+			Document{"ts": t0, "name": "up", "value": v, "labels": Document{"a": "1", "b": "2"}},
+			Document{"ts": t0, "name": "up", "value": v, "labels": Document{"a": "1"}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, _ := m.Find(ctx, Read{Database: "db", Collection: testCollection})
+	got := 0
+	for cursor.Next(ctx) {
+		var doc Document
+		if err := cursor.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc["value"] != 2.0 {
+			t.Errorf("value %v not replaced", doc["value"])
+		}
+		got++
+	}
+	if got != 2 {
+		t.Errorf("got %d documents, want 2", got)
+	}
+
+	filter := fmt.Sprint(upsertFilter(Document{"ts": t0, "value": 1.0, "labels": Document{"a": "1"}}, "value"))
+	if want := `map[$expr:map[$and:[map[$eq:[map[$size:map[$objectToArray:map[$ifNull:[$labels map[]]]]] 1]]]] labels.a:1 ts:2024-01-01 00:00:00 +0000 UTC]`; filter != want {
+		t.Errorf("upsert filter %s, want %s", filter, want)
+	}
+	filter = fmt.Sprint(upsertFilter(Document{"ts": t0, "reading": Document{"value": 1.0, "unit": "C"}}, "reading.value"))
+	if want := `map[$expr:map[$and:[map[$eq:[map[$size:map[$objectToArray:map[$ifNull:[$reading map[]]]]] 2]]]] reading.unit:C ts:2024-01-01 00:00:00 +0000 UTC]`; filter != want {
+		t.Errorf("upsert filter %s, want %s", filter, want)
+	}
+	if key := upsertKey(Document{"ts": t0, "reading": Document{"value": 1.0, "unit": "C"}}, "reading.value"); key != upsertKey(Document{"ts": t0, "reading": Document{"unit": "C", "value": 2.0}}, "reading.value") {
+		t.Errorf("upsert key %s depends on the value", key)
+	}
+}
@@ -0,0 +1,229 @@
+package translate
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Mongo runs reads against MongoDB.
+type Mongo struct {
+	client *mongo.Client
+}
+
+// NewMongo returns a backend reading through client.
+func NewMongo(client *mongo.Client) *Mongo {
+	return &Mongo{client: client}
+}
+
+func (m *Mongo) Find(ctx context.Context, read Read) (Cursor, error) {
+	cursor, err := m.client.Database(read.Database).Collection(read.Collection.Name).Find(ctx, Filter(read))
+	if err != nil {
+		return nil, err
+	}
+	if residual := read.Residual(); len(residual) > 0 {
+		return &residualCursor{Cursor: cursor, coll: read.Collection, matchers: residual}, nil
+	}
+	return cursor, nil
+}
+
+func (m *Mongo) Distinct(ctx context.Context, read Read, field string) ([]interface{}, error) {
+	return m.client.Database(read.Database).Collection(read.Collection.Name).Distinct(ctx, field, Filter(read))
+}
+
+func (m *Mongo) Insert(ctx context.Context, database, collection string, docs ...Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	many := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		many[i] = doc
+	}
+	_, err := m.client.Database(database).Collection(collection).InsertMany(ctx, many)
+	return err
+}
+
+func (m *Mongo) Upsert(ctx context.Context, database, collection, valueField string, docs ...Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(docs))
+	for i, doc := range docs {
+		value, _ := Lookup(doc, valueField)
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(upsertFilter(doc, valueField)).
+			SetUpdate(bson.M{"$set": bson.M{valueField: value}}).
+			SetUpsert(true)
+	}
+	_, err := m.client.Database(database).Collection(collection).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// upsertFilter matches the documents equal to doc in all fields but
+// valueField, which may be a dotted path. Subdocuments are matched field by
+// field, with a check that they have no further fields, so that the order
+// of their fields does not matter and an upsert creates them from the filter.
+func upsertFilter(doc Document, valueField string) bson.M {
+	filter := bson.M{}
+	if exprs := upsertFields(filter, "", doc, valueField); len(exprs) > 0 {
+		filter["$expr"] = bson.M{"$and": exprs}
+	}
+	return filter
+}
+
+// upsertFields adds the fields of a document, nested under prefix, to an
+// upsert filter and returns the size checks of its subdocuments.
+func upsertFields(filter bson.M, prefix string, doc map[string]interface{}, valueField string) []interface{} {
+	var exprs []interface{}
+	for field, v := range doc {
+		path := prefix + field
+		if path == valueField {
+			continue
+		}
+		sub, ok := v.(map[string]interface{})
+		if m, isM := v.(bson.M); isM {
+			sub, ok = m, true
+		}
+		if !ok {
+			filter[path] = v
+			continue
+		}
+		exprs = append(exprs, upsertFields(filter, path+".", sub, valueField)...)
+		size := bson.M{"$size": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$" + path, bson.M{}}}}}
+		exprs = append(exprs, bson.M{"$eq": bson.A{size, len(sub)}})
+	}
+	return exprs
+}
+
+// Filter renders a read as a MongoDB filter.
+func Filter(read Read) map[string]interface{} {
+	var filter map[string]interface{}
+	if !read.Start.IsZero() || !read.End.IsZero() {
+		filter = TimeRangeFilter(read.Collection.TimeField, read.Start, read.End)
+	}
+	for field, value := range read.Fields {
+		filter = MergeFilters(filter, map[string]interface{}{field: value})
+	}
+	return MergeFilters(filter, MatchersFilter(read.Matchers, read.Collection))
+}
+
+// TimeRangeFilter matches documents with the time field in [start, end). A
+// zero time leaves that side unbounded.
+func TimeRangeFilter(field string, start, end time.Time) map[string]interface{} {
+	bounds := map[string]interface{}{}
+	if !start.IsZero() {
+		bounds["$gte"] = start
+	}
+	if !end.IsZero() {
+		bounds["$lt"] = end
+	}
+	return map[string]interface{}{field: bounds}
+}
+
+// MergeFilters combines two MongoDB filters so that both must match.
+func MergeFilters(a, b map[string]interface{}) map[string]interface{} {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+	for k := range b {
+		if _, clash := a[k]; clash {
+			return map[string]interface{}{"$and": []interface{}{a, b}}
+		}
+	}
+	merged := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// matchNothing returns a MongoDB filter that no document satisfies.
+func matchNothing() map[string]interface{} {
+	return map[string]interface{}{"_id": map[string]interface{}{"$exists": false}}
+}
+
+// MatchersFilter translates label matchers into a MongoDB filter for a collection.
+// Labels that are not stored in a document field are decided statically from the
+// collection's default labels (or the empty value): a matcher that cannot match
+// turns the whole filter into one matching nothing. Matchers on derived labels
+// are translated where the derivation allows it, and matchers on relabeled
+// labels where relabeling can be traced back; see Read.Residual.
+func MatchersFilter(matchers []*labels.Matcher, coll Collection) map[string]interface{} {
+	pushed, _, ok := coll.pushdown(matchers)
+	if !ok {
+		return matchNothing()
+	}
+	var filter map[string]interface{}
+	for _, m := range pushed {
+		if d, derived := coll.DerivedLabel(m.Name); derived {
+			filter = MergeFilters(filter, derivedMatcherFilter(d, m))
+			continue
+		}
+		field, mapped := coll.LabelField(m.Name)
+		if !mapped {
+			if !m.Matches(coll.DefaultLbls[m.Name]) {
+				return matchNothing()
+			}
+			continue
+		}
+		filter = MergeFilters(filter, fieldMatcherFilter(field, coll.DefaultLbls[m.Name], m))
+	}
+	return filter
+}
+
+// derivedMatcherFilter narrows down the documents for a matcher on a derived
+// label. A label copying a field is matched exactly. Otherwise, a matcher
+// requiring the label requires its single source field to match the regex.
+func derivedMatcherFilter(d DerivedLabel, m *labels.Matcher) map[string]interface{} {
+	if field, ok := d.copiedField(); ok {
+		return fieldMatcherFilter(field, "", m)
+	}
+	if d.Template == "" && len(d.SourceFields) == 1 && !m.Matches("") {
+		return map[string]interface{}{d.SourceFields[0]: primitive.Regex{Pattern: "^(?:" + d.regex().String() + ")$", Options: "s"}}
+	}
+	return nil
+}
+
+// fieldMatcherFilter translates one matcher on a document field. A missing
+// (or null) field has the label's default value, or as in Prometheus the
+// empty value when there is no default.
+func fieldMatcherFilter(field, def string, m *labels.Matcher) map[string]interface{} {
+	absent := []interface{}{def, nil}
+	re := primitive.Regex{Pattern: "^(?:" + m.Value + ")$"}
+	switch m.Type {
+	case labels.MatchEqual:
+		if m.Value == def {
+			return map[string]interface{}{field: map[string]interface{}{"$in": absent}}
+		}
+		return map[string]interface{}{field: m.Value}
+	case labels.MatchNotEqual:
+		if m.Value == def {
+			return map[string]interface{}{field: map[string]interface{}{"$nin": absent}}
+		}
+		return map[string]interface{}{field: map[string]interface{}{"$ne": m.Value}}
+	case labels.MatchRegexp:
+		if m.Matches(def) {
+			return map[string]interface{}{"$or": []interface{}{
+				map[string]interface{}{field: re},
+				map[string]interface{}{field: map[string]interface{}{"$in": absent}},
+			}}
+		}
+		return map[string]interface{}{field: re}
+	default: // labels.MatchNotRegexp
+		if m.Matches(def) {
+			return map[string]interface{}{field: map[string]interface{}{"$not": re}}
+		}
+		return map[string]interface{}{field: map[string]interface{}{"$not": re, "$nin": absent}}
+	}
+}
@@ -0,0 +1,160 @@
+package translate
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// ErrDropped is returned by Extract for documents of series that relabeling
+// drops.
+var ErrDropped = errors.New("series dropped by relabeling")
+
+// relabelSeries applies the collection's relabel configs to extracted labels.
+func (c Collection) relabelSeries(lbls map[string]string) (map[string]string, error) {
+	if len(c.RelabelConfigs) == 0 {
+		return lbls, nil
+	}
+	lset, keep := relabel.Process(labels.FromMap(lbls), c.RelabelConfigs...)
+	if !keep {
+		return nil, ErrDropped
+	}
+	return lset.Map(), nil
+}
+
+// pushdown maps matchers on the labels of series to matchers on the labels
+// extracted from documents, before relabeling, and adds the keep and drop
+// actions on a single label. Matchers that cannot be traced back are left
+// out and exact is false. ok is false if a matcher can never match.
+func (c Collection) pushdown(matchers []*labels.Matcher) (pushed []*labels.Matcher, exact, ok bool) {
+	if len(c.RelabelConfigs) == 0 {
+		return matchers, true, true
+	}
+	exact = true
+	for _, m := range matchers {
+		name, known, removed := c.unrelabel(len(c.RelabelConfigs), m.Name)
+		switch {
+		case removed:
+			if !m.Matches("") {
+				return nil, true, false
+			}
+		case !known:
+			exact = false
+		default:
+			pushed = append(pushed, renameMatcher(m, name))
+		}
+	}
+	for i, cfg := range c.RelabelConfigs {
+		if (cfg.Action != relabel.Keep && cfg.Action != relabel.Drop) || len(cfg.SourceLabels) != 1 {
+			continue
+		}
+		name, known, removed := c.unrelabel(i, string(cfg.SourceLabels[0]))
+		if !known || removed {
+			continue
+		}
+		typ := labels.MatchRegexp
+		if cfg.Action == relabel.Drop {
+			typ = labels.MatchNotRegexp
+		}
+		if m, err := labels.NewMatcher(typ, name, cfg.Regex.String()); err == nil {
+			pushed = append(pushed, m)
+		}
+	}
+	return pushed, exact, true
+}
+
+// unrelabel returns the label that the first n relabel configs turn into
+// the named one. removed reports a label those configs always remove; known
+// is false when the label cannot be traced back, e.g. when it is computed.
+func (c Collection) unrelabel(n int, name string) (stored string, known, removed bool) {
+	for i := n - 1; i >= 0; i-- {
+		cfg := c.RelabelConfigs[i]
+		switch cfg.Action {
+		case relabel.Replace, relabel.HashMod, relabel.Lowercase, relabel.Uppercase:
+			if cfg.TargetLabel != name && !strings.Contains(cfg.TargetLabel, "$") {
+				continue
+			}
+			if cfg.TargetLabel == name && renames(cfg) {
+				name = string(cfg.SourceLabels[0])
+				continue
+			}
+			return "", false, false
+		case relabel.LabelMap:
+			if cfg.Replacement == name || strings.Contains(cfg.Replacement, "$") {
+				return "", false, false
+			}
+		case relabel.LabelDrop:
+			if cfg.Regex.MatchString(name) {
+				return "", true, true
+			}
+		case relabel.LabelKeep:
+			if !cfg.Regex.MatchString(name) {
+				return "", true, true
+			}
+		}
+	}
+	return name, true, false
+}
+
+// renames reports a replace action copying one label unchanged.
+func renames(cfg *relabel.Config) bool {
+	return cfg.Action == relabel.Replace && len(cfg.SourceLabels) == 1 && cfg.Regex.String() == "(.*)" &&
+		(cfg.Replacement == "$1" || cfg.Replacement == "${1}")
+}
+
+func renameMatcher(m *labels.Matcher, name string) *labels.Matcher {
+	if m.Name == name {
+		return m
+	}
+	renamed, err := labels.NewMatcher(m.Type, name, m.Value)
+	if err != nil {
+		return m // the value compiled before
+	}
+	return renamed
+}
+
+// relabeledNames applies the label name changes of the relabel configs to a
+// set of label names: targets are added, labelmap copies and labeldrop and
+// labelkeep removals are applied.
+func (c Collection) relabeledNames(names []string) []string {
+	for _, cfg := range c.RelabelConfigs {
+		switch cfg.Action {
+		case relabel.Replace, relabel.HashMod, relabel.Lowercase, relabel.Uppercase:
+			if !strings.Contains(cfg.TargetLabel, "$") {
+				names = append(names, cfg.TargetLabel)
+			}
+		case relabel.LabelMap:
+			for _, n := range names {
+				if cfg.Regex.MatchString(n) {
+					names = append(names, cfg.Regex.ReplaceAllString(n, cfg.Replacement))
+				}
+			}
+		case relabel.LabelDrop:
+			names = slices.DeleteFunc(names, cfg.Regex.MatchString)
+		case relabel.LabelKeep:
+			names = slices.DeleteFunc(names, func(n string) bool { return !cfg.Regex.MatchString(n) })
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// LabelNames returns the names of the labels the collection's series can
+// have, apart from labels in the labels subdocument.
+func (c Collection) LabelNames() []string {
+	names := []string{model.MetricNameLabel}
+	for l := range c.LabelFields {
+		names = append(names, l)
+	}
+	for l := range c.DefaultLbls {
+		names = append(names, l)
+	}
+	for _, d := range c.DerivedLabels {
+		names = append(names, d.Name)
+	}
+	return c.relabeledNames(names)
+}
@@ -0,0 +1,215 @@
+package translate
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// ValueTransform converts stored values into the values of the samples, for
+// collections that do not store Prometheus base units. The stored value is
+// converted from Unit, multiplied by Scale, Offset is added and with Invert
+// the reciprocal is taken.
+type ValueTransform struct {
+	Unit   string   `yaml:"unit"`   // unit of the stored value, see Units
+	Scale  *float64 `yaml:"scale"`  // factor, 1 if unset
+	Offset float64  `yaml:"offset"` // added after scaling
+	Invert bool     `yaml:"invert"` // 1/v, e.g. for a period stored instead of a frequency
+}
+
+// Units maps the stored units a ValueTransform accepts to the factor
+// converting them to the Prometheus base unit: seconds, bytes or a ratio.
+var Units = map[string]float64{
+	"ns":      1e-9,
+	"us":      1e-6,
+	"ms":      1e-3,
+	"s":       1,
+	"m":       60,
+	"minutes": 60,
+	"h":       3600,
+	"hours":   3600,
+	"d":       86400,
+	"days":    86400,
+	"bits":    0.125,
+	"KB":      1e3,
+	"MB":      1e6,
+	"GB":      1e9,
+	"TB":      1e12,
+	"KiB":     1 << 10,
+	"MiB":     1 << 20,
+	"GiB":     1 << 30,
+	"TiB":     1 << 40,
+	"percent": 0.01,
+}
+
+// IsZero reports whether the transform leaves values unchanged.
+func (t ValueTransform) IsZero() bool {
+	return t.Unit == "" && t.Scale == nil && t.Offset == 0 && !t.Invert
+}
+
+// factor is the combined unit and scale factor.
+func (t ValueTransform) factor() float64 {
+	f := 1.0
+	if t.Unit != "" {
+		f = Units[t.Unit]
+	}
+	if t.Scale != nil {
+		f *= *t.Scale
+	}
+	return f
+}
+
+// Apply converts a stored value.
+func (t ValueTransform) Apply(v float64) float64 {
+	if t.IsZero() {
+		return v
+	}
+	v = v*t.factor() + t.Offset
+	if t.Invert {
+		v = 1 / v
+	}
+	return v
+}
+
+// Reverse converts a sample value into the value to store.
+func (t ValueTransform) Reverse(v float64) float64 {
+	if t.IsZero() {
+		return v
+	}
+	if t.Invert {
+		v = 1 / v
+	}
+	return (v - t.Offset) / t.factor()
+}
+
+// Expression renders the transform as a MongoDB aggregation expression of
+// the stored value.
+func (t ValueTransform) Expression(value interface{}) interface{} {
+	if t.IsZero() {
+		return value
+	}
+	if f := t.factor(); f != 1 {
+		value = map[string]interface{}{"$multiply": []interface{}{value, f}}
+	}
+	if t.Offset != 0 {
+		value = map[string]interface{}{"$add": []interface{}{value, t.Offset}}
+	}
+	if t.Invert {
+		value = map[string]interface{}{"$divide": []interface{}{1.0, value}}
+	}
+	return value
+}
+
+func (t ValueTransform) validate() error {
+	if _, ok := Units[t.Unit]; t.Unit != "" && !ok {
+		return fmt.Errorf("unknown unit %q", t.Unit)
+	}
+	if t.Scale != nil && *t.Scale == 0 {
+		return fmt.Errorf("scale must not be 0")
+	}
+	return nil
+}
+
+// DerivedLabel computes a label from document fields, like a relabel_configs
+// replace action: the source value is Template with ${field} references
+// expanded, or else the SourceFields joined by Separator. If it matches
+// Regex, the label is Replacement with $1 and friends expanded; otherwise,
+// or when that is empty, the document does not have the label.
+type DerivedLabel struct {
+	Name         string         `yaml:"name"`
+	Template     string         `yaml:"template"`     // e.g. "${host}:${port}"
+	SourceFields []string       `yaml:"sourceFields"` // document fields, possibly dotted
+	Separator    *string        `yaml:"separator"`    // ";" if unset
+	Regex        relabel.Regexp `yaml:"regex"`        // anchored, "(.*)" if unset
+	Replacement  *string        `yaml:"replacement"`  // "$1" if unset
+}
+
+func (d DerivedLabel) regex() relabel.Regexp {
+	if d.Regex.Regexp == nil {
+		return relabel.DefaultRelabelConfig.Regex
+	}
+	return d.Regex
+}
+
+func (d DerivedLabel) replacement() string {
+	if d.Replacement == nil {
+		return relabel.DefaultRelabelConfig.Replacement
+	}
+	return *d.Replacement
+}
+
+// Value computes the label for a document.
+func (d DerivedLabel) Value(doc Document) string {
+	var src string
+	if d.Template != "" {
+		src = os.Expand(d.Template, func(field string) string { return fieldString(doc, field) })
+	} else {
+		sep := relabel.DefaultRelabelConfig.Separator
+		if d.Separator != nil {
+			sep = *d.Separator
+		}
+		vals := make([]string, len(d.SourceFields))
+		for i, field := range d.SourceFields {
+			vals[i] = fieldString(doc, field)
+		}
+		src = strings.Join(vals, sep)
+	}
+	return d.Apply(src)
+}
+
+// Apply computes the label from a source value.
+func (d DerivedLabel) Apply(src string) string {
+	re := d.regex()
+	idx := re.FindStringSubmatchIndex(src)
+	if idx == nil {
+		return ""
+	}
+	return string(re.ExpandString(nil, d.replacement(), src, idx))
+}
+
+// Fields returns the document fields the label is computed from.
+func (d DerivedLabel) Fields() []string {
+	if d.Template == "" {
+		return d.SourceFields
+	}
+	var fields []string
+	os.Expand(d.Template, func(field string) string {
+		fields = append(fields, field)
+		return ""
+	})
+	sort.Strings(fields)
+	return fields
+}
+
+// copiedField returns the field a label copies unchanged, if it does.
+func (d DerivedLabel) copiedField() (string, bool) {
+	if d.Template != "" || len(d.SourceFields) != 1 || d.regex().String() != "(.*)" || d.replacement() != "$1" {
+		return "", false
+	}
+	return d.SourceFields[0], true
+}
+
+func (d DerivedLabel) validate() error {
+	switch {
+	case !model.LabelName(d.Name).IsValidLegacy() || d.Name == model.MetricNameLabel:
+		return fmt.Errorf("invalid derived label name %q", d.Name)
+	case d.Template == "" && len(d.SourceFields) == 0:
+		return fmt.Errorf("derived label %q needs a template or sourceFields", d.Name)
+	case d.Template != "" && len(d.SourceFields) > 0:
+		return fmt.Errorf("derived label %q has both a template and sourceFields", d.Name)
+	}
+	return nil
+}
+
+// fieldString returns a document field as a label value.
+func fieldString(doc Document, field string) string {
+	v, ok := Lookup(doc, field)
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,167 @@
+// Package translate turns PromQL selectors into reads of a document store
+// holding one sample per document, and runs them against a Backend: MongoDB
+// or an in-memory store.
+//
+// A Translator plans the reads for a selector and a time range from the
+// collection layouts and metric mappings of a configuration. The plan does
+// not depend on the backend; Filter renders a read as a MongoDB filter.
+package translate
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ErrUnsupported is returned for queries that cannot be translated into reads.
+var ErrUnsupported = errors.New("query cannot be translated")
+
+// Translator plans the reads for PromQL selectors.
+type Translator struct {
+	Database    string
+	Collections map[string]Collection // keyed as referenced by Mappings
+	Mappings    map[string]string     // metric name -> collection key
+	Fields      map[string]string     // document fields every read requires, e.g. a tenant ID
+	Matchers    []*labels.Matcher     // added to every selector, e.g. an access policy
+}
+
+// Plan is the set of reads answering a selector.
+type Plan struct {
+	Reads []Read
+}
+
+// Read selects the documents of one collection.
+type Read struct {
+	Database   string
+	Key        string // collection key in the configuration
+	Collection Collection
+	Matchers   []*labels.Matcher
+	Fields     map[string]string
+	// Start and End bound the time field to [Start, End). A zero time leaves
+	// that side unbounded.
+	Start, End time.Time
+}
+
+// Residual returns the matchers a read's filter cannot decide, to be checked
+// on the series of the documents returned: matchers on labels derived from
+// several fields or by a template, and all matchers if one cannot be traced
+// back through relabeling.
+func (r Read) Residual() []*labels.Matcher {
+	pushed, exact, _ := r.Collection.pushdown(r.Matchers)
+	computed := slices.ContainsFunc(pushed, func(m *labels.Matcher) bool {
+		d, derived := r.Collection.DerivedLabel(m.Name)
+		_, copied := d.copiedField()
+		return derived && !copied
+	})
+	if exact && !computed {
+		return nil
+	}
+	return r.Matchers
+}
+
+// Translate plans the reads for a series selector such as
+// http_requests_total{code="500"} or a range selector, between start and end.
+// Other expressions, offset and @ are not supported and return ErrUnsupported.
+func (t *Translator) Translate(query string, start, end time.Time) (*Plan, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	var vs *parser.VectorSelector
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		vs = e
+	case *parser.MatrixSelector:
+		vs = e.VectorSelector.(*parser.VectorSelector)
+	default:
+		return nil, fmt.Errorf("%w: only series selectors are supported, not %s", ErrUnsupported, describeNode(expr))
+	}
+	if vs.OriginalOffset != 0 || vs.Timestamp != nil || vs.StartOrEnd != 0 {
+		return nil, fmt.Errorf("%w: offset and @ modifiers are not supported", ErrUnsupported)
+	}
+	plan, err := t.Select(vs.LabelMatchers, start, end)
+	if err == nil && len(plan.Reads) == 0 {
+		err = fmt.Errorf("%w: no mapped metric matches %s", ErrUnsupported, vs)
+	}
+	return plan, err
+}
+
+// Select plans the reads for label matchers between start and end: one read
+// per collection holding a metric whose name matches, none if there is none.
+func (t *Translator) Select(matchers []*labels.Matcher, start, end time.Time) (*Plan, error) {
+	plan := &Plan{}
+	for _, key := range t.CollectionKeys(matchers) {
+		coll, ok := t.Collections[key]
+		if !ok {
+			return nil, fmt.Errorf("mapping refers to unknown collection %q", key)
+		}
+		ms := matchers
+		if coll.MetricField == "" {
+			// The mapping already selected the collection by name; its
+			// documents carry no name to match.
+			ms = slices.DeleteFunc(slices.Clone(matchers), func(m *labels.Matcher) bool {
+				return m.Name == model.MetricNameLabel
+			})
+		}
+		plan.Reads = append(plan.Reads, Read{
+			Database:   t.Database,
+			Key:        key,
+			Collection: coll,
+			Matchers:   slices.Concat(ms, t.Matchers),
+			Fields:     t.Fields,
+			Start:      start,
+			End:        end,
+		})
+	}
+	return plan, nil
+}
+
+// CollectionKeys returns the sorted keys of the collections that hold metrics
+// matching the __name__ matchers. Without a name matcher every mapped
+// collection is a candidate.
+func (t *Translator) CollectionKeys(matchers []*labels.Matcher) []string {
+	keys := map[string]bool{}
+	for metric, key := range t.Mappings {
+		matches := true
+		for _, m := range matchers {
+			if m.Name == model.MetricNameLabel && !m.Matches(metric) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			keys[key] = true
+		}
+	}
+	out := make([]string, 0, len(keys))
+	for k := range keys {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// describeNode names an AST node for error messages.
+func describeNode(n parser.Node) string {
+	switch e := n.(type) {
+	case *parser.Call:
+		return "function " + e.Func.Name + "()"
+	case *parser.AggregateExpr:
+		return "aggregation " + e.Op.String()
+	case *parser.BinaryExpr:
+		return "binary operator " + e.Op.String()
+	case *parser.SubqueryExpr:
+		return "a subquery"
+	case *parser.ParenExpr:
+		return describeNode(e.Expr)
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return "a literal"
+	}
+	return fmt.Sprintf("%T", n)
+}
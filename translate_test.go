@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+)
+
+func TestPrintReadsResidualMatchers(t *testing.T) {
+	coll := translate.Collection{
+		Name: "http", TimeField: "ts", MetricField: "name", ValueField: "value",
+		LabelFields:   map[string]string{"code": "status"},
+		DerivedLabels: []translate.DerivedLabel{{Name: "instance", Template: "${host}:${port}"}},
+	}
+	tr := &translate.Translator{Database: "metrics", Collections: map[string]translate.Collection{"http": coll}, Mappings: map[string]string{"http_requests_total": "http"}}
+	plan, err := tr.Select([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total"),
+		labels.MustNewMatcher(labels.MatchEqual, "instance", "web-1:80"),
+	}, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := printReads(&out, "metrics", plan.Reads, "mongosh"); err != nil {
+		t.Fatal(err)
+	}
+	want := `db.getSiblingDB("metrics").getCollection("http").find({name: "http_requests_total"})
+// then matched by the bridge: {__name__="http_requests_total", instance="web-1:80"}
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := printReads(&out, "metrics", plan.Reads, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(`"residualMatchers": [
+    "__name__=\"http_requests_total\"",
+    "instance=\"web-1:80\""
+  ]`)) {
+		t.Errorf("residual matchers missing from\n%s", out.String())
+	}
+}
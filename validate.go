@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const defaultSampleSize = 100
+
+// findings collects the problems found by validate.
+type findings struct {
+	out      io.Writer
+	errors   int
+	warnings int
+}
+
+func (f *findings) errorf(format string, args ...interface{}) {
+	f.errors++
+	fmt.Fprintf(f.out, "ERROR   "+format+"\n", args...)
+}
+
+func (f *findings) warnf(format string, args ...interface{}) {
+	f.warnings++
+	fmt.Fprintf(f.out, "WARNING "+format+"\n", args...)
+}
+
+func (f *findings) okf(format string, args ...interface{}) {
+	fmt.Fprintf(f.out, "OK      "+format+"\n", args...)
+}
+
+// runValidateCommand implements the "validate" subcommand: it checks the
+// references within the configuration and, unless -offline, samples
+// documents of every collection to verify the mapped fields exist with
+// types the bridge can read. It exits with 1 when errors were found.
+func runValidateCommand(args []string) int {
+	fs, configFile := commandFlags("validate")
+	samples := fs.Int("samples", defaultSampleSize, "Documents to sample per collection")
+	offline := fs.Bool("offline", false, "Only check the configuration, do not connect to MongoDB")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	f := &findings{out: os.Stdout}
+	if err := loadConfig(*configFile); err != nil {
+		f.errorf("%s: %v", *configFile, err)
+		return 1
+	}
+	validateConfig(f)
+
+	if !*offline {
+		ctx, cancel := commandContext()
+		defer cancel()
+		client, err := commandConnect(ctx)
+		if err != nil {
+			f.errorf("connecting to MongoDB: %v", err)
+		} else {
+			defer client.Disconnect(context.Background())
+			for _, db := range validationDatabases() {
+				validateDocuments(ctx, f, client.Database(db.name), db.collections, *samples)
+			}
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "\n%d error(s), %d warning(s)\n", f.errors, f.warnings)
+	if f.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// validateConfig checks the configuration without connecting to MongoDB.
+func validateConfig(f *findings) {
+	if err := validateTenancy(conf.Tenancy); err != nil {
+		f.errorf("%v", err)
+	}
+	if err := validateRollups(conf.Collections); err != nil {
+		f.errorf("%v", err)
+	}
+	if err := loadAccessPolicies(conf.AccessPolicies); err != nil {
+		f.errorf("%v", err)
+	}
+	if _, err := buildTLSConfig(conf.Server.TLS); err != nil {
+		f.errorf("server.tls: %v", err)
+	}
+	if _, err := newAuthenticator(conf.Server.BasicAuthUsers, conf.Server.BearerTokens); err != nil {
+		f.errorf("server authentication: %v", err)
+	}
+
+	validateCollections(f, "collections", conf.Collections)
+	validateMappings(f, "mappings", conf.Mappings, conf.Collections)
+	for id, t := range conf.Tenancy.Tenants {
+		validateCollections(f, "tenants."+id+".collections", t.Collections)
+		validateMappings(f, "tenants."+id+".mappings", mergeMaps(conf.Mappings, t.Mappings), mergeMaps(conf.Collections, t.Collections))
+	}
+	if c := conf.OTLP.Collection; conf.OTLP.Enabled && c != "" {
+		if _, ok := conf.Collections[c]; !ok {
+			f.errorf("otlp.collection: unknown collection %q", c)
+		}
+	}
+	validateRules(f)
+}
+
+func validateCollections(f *findings, path string, collections map[string]CollectionInfo) {
+	for _, key := range sortedKeys(collections) {
+		c := collections[key]
+		where := path + "." + key
+		if c.Name == "" {
+			f.errorf("%s: name is empty", where)
+		}
+		if c.TimeField == "" {
+			f.errorf("%s: timeField is empty", where)
+		}
+		if c.ValueField == "" {
+			f.errorf("%s: valueField is empty", where)
+		}
+		if err := c.Validate(); err != nil {
+			f.errorf("%s: %v", where, err)
+		}
+		if c.MetricField == "" && c.DefaultLbls[model.MetricNameLabel] == "" {
+			f.warnf("%s: no metricField and no __name__ default label; series have no metric name", where)
+		}
+		for label := range c.LabelFields {
+			if !model.LabelName(label).IsValidLegacy() {
+				f.errorf("%s.labelFields: %q is not a valid label name", where, label)
+			}
+		}
+	}
+}
+
+func validateMappings(f *findings, path string, mappings map[string]Mapping, collections map[string]CollectionInfo) {
+	for _, metric := range sortedKeys(mappings) {
+		m := mappings[metric]
+		if _, ok := collections[m.Collection]; !ok {
+			f.errorf("%s.%s: refers to unknown collection %q", path, metric, m.Collection)
+		}
+		if m.Type != "" && !metricTypes[m.Type] {
+			f.errorf("%s.%s: unknown metric type %q", path, metric, m.Type)
+		}
+	}
+}
+
+func validateRules(f *findings) {
+	cfg := conf.Rules
+	if len(cfg.Files) == 0 {
+		return
+	}
+	if out, ok := conf.Collections[cfg.OutputCollection]; !ok {
+		f.errorf("rules.outputCollection: unknown collection %q", cfg.OutputCollection)
+	} else if out.LabelsField == "" {
+		f.errorf("rules.outputCollection: collection %q needs a labelsField", cfg.OutputCollection)
+	}
+	if cfg.AlertStateCollection != "" {
+		if state, ok := conf.Collections[cfg.AlertStateCollection]; !ok {
+			f.errorf("rules.alertStateCollection: unknown collection %q", cfg.AlertStateCollection)
+		} else if state.LabelsField == "" {
+			f.errorf("rules.alertStateCollection: collection %q needs a labelsField", cfg.AlertStateCollection)
+		}
+	}
+	for _, pattern := range cfg.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			f.errorf("rules.files: invalid pattern %q: %v", pattern, err)
+			continue
+		}
+		if len(matches) == 0 {
+			f.warnf("rules.files: %q matches no file", pattern)
+		}
+		for _, file := range matches {
+			groups, errs := rulefmt.ParseFile(file, false)
+			for _, err := range errs {
+				f.errorf("%s: %v", file, err)
+			}
+			if groups == nil {
+				continue
+			}
+			for _, g := range groups.Groups {
+				for _, rule := range g.Rules {
+					expr, err := parser.ParseExpr(rule.Expr)
+					if err != nil {
+						continue
+					}
+					for _, metric := range ratedGauges(expr, conf.Mappings) {
+						f.warnf("%s: %s applies a counter function to gauge %q", file, rule.Record+rule.Alert, metric)
+					}
+				}
+			}
+		}
+	}
+}
+
+type validationDatabase struct {
+	name        string
+	collections map[string]CollectionInfo
+}
+
+// validationDatabases lists the databases to sample: the configured one and,
+// in database tenancy mode, the database of every listed tenant.
+func validationDatabases() []validationDatabase {
+	dbs := []validationDatabase{{name: conf.MongoDB.Database, collections: conf.Collections}}
+	t := conf.Tenancy
+	if !t.Enabled || (t.Mode != "" && t.Mode != "database") {
+		return dbs
+	}
+	dbs = dbs[:0]
+	for _, id := range sortedKeys(t.Tenants) {
+		name, err := tenantDatabase(t, id)
+		if err != nil {
+			continue
+		}
+		dbs = append(dbs, validationDatabase{name: name, collections: mergeMaps(conf.Collections, t.Tenants[id].Collections)})
+	}
+	return dbs
+}
+
+// validateDocuments samples each collection and checks its mapped fields.
+func validateDocuments(ctx context.Context, f *findings, db *mongo.Database, collections map[string]CollectionInfo, samples int) {
+	existing, err := db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		f.errorf("%s: listing collections: %v", db.Name(), err)
+		return
+	}
+	for _, key := range sortedKeys(collections) {
+		c := collections[key]
+		where := db.Name() + "." + c.Name
+		if !slices.Contains(existing, c.Name) {
+			// Rule output is created on the first write.
+			if len(conf.Rules.Files) > 0 && (key == conf.Rules.OutputCollection || key == conf.Rules.AlertStateCollection) {
+				f.warnf("%s (%s): collection does not exist yet", where, key)
+			} else {
+				f.errorf("%s (%s): collection does not exist", where, key)
+			}
+			continue
+		}
+		docs, err := sampleDocuments(ctx, db.Collection(c.Name), samples)
+		if err != nil {
+			f.errorf("%s: sampling documents: %v", where, err)
+			continue
+		}
+		if len(docs) == 0 {
+			f.warnf("%s (%s): collection is empty, fields not checked", where, key)
+			continue
+		}
+		checkField(f, where, "timeField", c.TimeField, docs, readableTime)
+		checkField(f, where, "valueField", c.ValueField, docs, readableValue)
+		if c.MetricField != "" {
+			checkField(f, where, "metricField", c.MetricField, docs, isString)
+		}
+		for _, label := range sortedKeys(c.LabelFields) {
+			checkField(f, where, "labelFields."+label, c.LabelFields[label], docs, isString)
+		}
+		if c.LabelsField != "" {
+			checkField(f, where, "labelsField", c.LabelsField, docs, func(v interface{}) bool { return translate.Subdocument(v) != nil })
+		}
+	}
+}
+
+// sampleDocuments returns up to n random documents of a collection.
+func sampleDocuments(ctx context.Context, coll *mongo.Collection, n int) ([]map[string]interface{}, error) {
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$sample", Value: bson.M{"size": n}}}})
+	if err != nil {
+		return nil, err
+	}
+	var docs []map[string]interface{}
+	err = cursor.All(ctx, &docs)
+	return docs, err
+}
+
+// checkField reports how often a mapped field, possibly a dotted path, is
+// present and readable.
+// A field missing from every sampled document is almost certainly a typo and
+// an error; partially missing or unreadable values are warnings.
+func checkField(f *findings, where, setting, field string, docs []map[string]interface{}, readable func(interface{}) bool) {
+	types := map[string]int{}
+	present, bad := 0, 0
+	for _, doc := range docs {
+		v, ok := translate.Lookup(doc, field)
+		if !ok {
+			continue
+		}
+		present++
+		types[bsonTypeName(v)]++
+		if !readable(v) {
+			bad++
+		}
+	}
+	summary := fmt.Sprintf("%s: %s %q present in %d/%d sampled documents (%s)", where, setting, field, present, len(docs), typeSummary(types))
+	switch {
+	case present == 0:
+		f.errorf("%s", summary)
+	case bad == present:
+		f.errorf("%s; no value is usable", summary)
+	case bad > 0 || present < len(docs):
+		f.warnf("%s; %d unusable value(s)", summary, bad)
+	default:
+		f.okf("%s", summary)
+	}
+}
+
+func typeSummary(types map[string]int) string {
+	parts := make([]string, 0, len(types))
+	for _, t := range sortedKeys(types) {
+		parts = append(parts, fmt.Sprintf("%s: %d", t, types[t]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// readableTime accepts the time representations Collection.ExtractSample understands.
+func readableTime(v interface{}) bool {
+	switch t := v.(type) {
+	case primitive.DateTime, time.Time, float64, int64, int32:
+		return true
+	case string:
+		_, err := time.Parse(time.RFC3339Nano, t)
+		return err == nil
+	}
+	return false
+}
+
+// readableValue accepts the value representations Collection.Extract understands.
+func readableValue(v interface{}) bool {
+	_, ok := translate.Value(v)
+	return ok
+}
+
+func isString(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+// bsonTypeName names the BSON type of a decoded value.
+func bsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "double"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case bool:
+		return "bool"
+	case primitive.DateTime, time.Time:
+		return "date"
+	case primitive.Decimal128:
+		return "decimal"
+	case primitive.ObjectID:
+		return "objectId"
+	case primitive.A, []interface{}:
+		return "array"
+	case map[string]interface{}, primitive.M, primitive.D:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/radek-ryckowski/promql2monogo/translate"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCheckField(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"ts": primitive.NewDateTimeFromTime(time.Unix(0, 0)), "job": "api", "meta": map[string]interface{}{"ts": "2024-01-01T00:00:00Z", "host": "a"}},
+		{"ts": "yesterday", "job": 7, "meta": primitive.M{"ts": "2024-01-01T00:00:10Z"}},
+	}
+	for _, tc := range []struct {
+		field    string
+		readable func(interface{}) bool
+		want     string
+	}{
+		{field: "ts", readable: readableTime, want: `WARNING db.c: timeField "ts" present in 2/2 sampled documents (date: 1, string: 1); 1 unusable value(s)`},
+		{field: "meta.ts", readable: readableTime, want: `OK      db.c: timeField "meta.ts" present in 2/2 sampled documents (string: 2)`},
+		{field: "meta.host", readable: isString, want: `WARNING db.c: timeField "meta.host" present in 1/2 sampled documents (string: 1); 0 unusable value(s)`},
+		{field: "job", readable: readableTime, want: `ERROR   db.c: timeField "job" present in 2/2 sampled documents (int: 1, string: 1); no value is usable`},
+		{field: "time", readable: readableTime, want: `ERROR   db.c: timeField "time" present in 0/2 sampled documents ()`},
+	} {
+		var out bytes.Buffer
+		checkField(&findings{out: &out}, "db.c", "timeField", tc.field, docs, tc.readable)
+		if got := strings.TrimSpace(out.String()); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.field, got, tc.want)
+		}
+	}
+}
+
+func TestReadableTime(t *testing.T) {
+	for _, tc := range []struct {
+		v    interface{}
+		want bool
+	}{
+		{v: primitive.NewDateTimeFromTime(time.Unix(0, 0)), want: true},
+		{v: time.Unix(0, 0), want: true},
+		{v: 1.7e9, want: true},
+		{v: int64(1700000000), want: true},
+		{v: int32(1700000000), want: true},
+		{v: "2024-01-01T00:00:00Z", want: true},
+		{v: "2024-01-01T00:00:00.123+02:00", want: true},
+		{v: "2024-01-01 00:00:00", want: false},
+		{v: true, want: false},
+		{v: nil, want: false},
+	} {
+		if got := readableTime(tc.v); got != tc.want {
+			t.Errorf("readableTime(%#v) = %v, want %v", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestBSONTypeName(t *testing.T) {
+	for _, tc := range []struct {
+		v    interface{}
+		want string
+	}{
+		{v: nil, want: "null"},
+		{v: "a", want: "string"},
+		{v: 1.5, want: "double"},
+		{v: int32(1), want: "int"},
+		{v: int64(1), want: "long"},
+		{v: false, want: "bool"},
+		{v: primitive.DateTime(0), want: "date"},
+		{v: time.Time{}, want: "date"},
+		{v: primitive.NewDecimal128(0, 1), want: "decimal"},
+		{v: primitive.NewObjectID(), want: "objectId"},
+		{v: primitive.A{1}, want: "array"},
+		{v: []interface{}{1}, want: "array"},
+		{v: map[string]interface{}{}, want: "object"},
+		{v: primitive.M{}, want: "object"},
+		{v: primitive.D{}, want: "object"},
+		{v: primitive.Binary{}, want: "primitive.Binary"},
+	} {
+		if got := bsonTypeName(tc.v); got != tc.want {
+			t.Errorf("bsonTypeName(%#v) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestDottedFieldPaths(t *testing.T) {
+	defer func() { backendOverride = nil }()
+	mem := translate.NewMemory()
+	backendOverride = mem
+	coll := CollectionInfo{Collection: translate.Collection{
+		Name:        "events",
+		TimeField:   "meta.ts",
+		MetricField: "meta.name",
+		ValueField:  "reading.value",
+		LabelFields: map[string]string{"host": "meta.host"},
+		LabelsField: "meta.tags",
+	}}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	l := labels.FromStrings("__name__", "temperature", "host", "a", "zone", "z1")
+	if err := mem.Insert(ctx, "db", "events", sampleToDoc(l, t0.UnixMilli(), 21.5, coll)); err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := mem.Find(ctx, translate.Read{Database: "db", Collection: coll.Collection})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []map[string]interface{}
+	for cursor.Next(ctx) {
+		var doc translate.Document
+		if err := cursor.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+	var out bytes.Buffer
+	f := &findings{out: &out}
+	checkField(f, "db.events", "timeField", coll.TimeField, docs, readableTime)
+	checkField(f, "db.events", "valueField", coll.ValueField, docs, readableValue)
+	checkField(f, "db.events", "metricField", coll.MetricField, docs, isString)
+	checkField(f, "db.events", "labelFields.host", coll.LabelFields["host"], docs, isString)
+	checkField(f, "db.events", "labelsField", coll.LabelsField, docs, func(v interface{}) bool { return translate.Subdocument(v) != nil })
+	if f.errors+f.warnings > 0 {
+		t.Errorf("validate reported problems:\n%s", out.String())
+	}
+
+	scope := &queryScope{Database: "db", Collections: map[string]CollectionInfo{"events": coll}, Mappings: map[string]Mapping{"temperature": {Collection: "events"}}}
+	q, _ := mongoQueryable{scope: scope}.Querier(t0.Add(-time.Minute).UnixMilli(), t0.Add(time.Minute).UnixMilli())
+	set := q.Select(ctx, false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "temperature"), labels.MustNewMatcher(labels.MatchEqual, "host", "a"))
+	var got []string
+	for set.Next() {
+		it := set.At().Iterator(nil)
+		for it.Next() == chunkenc.ValFloat {
+			ts, v := it.At()
+			got = append(got, fmt.Sprintf("%s %d %g", set.At().Labels(), ts, v))
+		}
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{fmt.Sprintf(`{__name__="temperature", host="a", zone="z1"} %d 21.5`, t0.UnixMilli())}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}